@@ -0,0 +1,229 @@
+package hvif
+
+import (
+	"math"
+)
+
+// Box is an axis aligned rectangle, empty if Min is greater than Max.
+type Box struct {
+	Min, Max Point
+}
+
+func emptyBox() Box {
+	inf := float32(math.Inf(1))
+
+	return Box{Min: Point{inf, inf}, Max: Point{-inf, -inf}}
+}
+
+func (b Box) Empty() bool {
+	return b.Min.X > b.Max.X || b.Min.Y > b.Max.Y
+}
+
+func (b Box) Width() float32 {
+	return max(b.Max.X-b.Min.X, 0)
+}
+
+func (b Box) Height() float32 {
+	return max(b.Max.Y-b.Min.Y, 0)
+}
+
+func (b Box) Center() Point {
+	return Point{X: (b.Min.X + b.Max.X) / 2, Y: (b.Min.Y + b.Max.Y) / 2}
+}
+
+func (b Box) Contains(p Point) bool {
+	return p.X >= b.Min.X && p.X <= b.Max.X && p.Y >= b.Min.Y && p.Y <= b.Max.Y
+}
+
+func (b Box) Union(o Box) Box {
+	return Box{
+		Min: Point{X: min(b.Min.X, o.Min.X), Y: min(b.Min.Y, o.Min.Y)},
+		Max: Point{X: max(b.Max.X, o.Max.X), Y: max(b.Max.Y, o.Max.Y)},
+	}
+}
+
+func (b Box) add(p Point) Box {
+	return b.Union(Box{Min: p, Max: p})
+}
+
+// expand grows the box by d on every side.
+func (b Box) expand(d float32) Box {
+	if b.Empty() {
+		return b
+	}
+
+	return Box{Min: Point{X: b.Min.X - d, Y: b.Min.Y - d}, Max: Point{X: b.Max.X + d, Y: b.Max.Y + d}}
+}
+
+// transform returns the box holding the transformed corners of b.
+func (b Box) transform(t interface{ Apply(Point) Point }) Box {
+	if b.Empty() {
+		return b
+	}
+
+	res := emptyBox()
+	for _, p := range []Point{b.Min, {X: b.Max.X, Y: b.Min.Y}, b.Max, {X: b.Min.X, Y: b.Max.Y}} {
+		res = res.add(t.Apply(p))
+	}
+
+	return res
+}
+
+// cubicExtrema returns the parameters in (0, 1) at which a coordinate of the
+// cubic curve p0, p1, p2, p3 reaches an extremum.
+func cubicExtrema(p0, p1, p2, p3 float32) []float64 {
+	// Derivative divided by 3 is a*t^2 + b*t + c
+	a := float64(-p0 + 3*p1 - 3*p2 + p3)
+	b := 2 * float64(p0-2*p1+p2)
+	c := float64(p1 - p0)
+
+	var roots []float64
+	switch {
+	case math.Abs(a) < 1e-12:
+		if b != 0 {
+			roots = append(roots, -c/b)
+		}
+	default:
+		disc := b*b - 4*a*c
+		if disc < 0 {
+			return nil
+		}
+		sq := math.Sqrt(disc)
+		roots = append(roots, (-b+sq)/(2*a), (-b-sq)/(2*a))
+	}
+
+	res := roots[:0]
+	for _, t := range roots {
+		if t > 0 && t < 1 {
+			res = append(res, t)
+		}
+	}
+
+	return res
+}
+
+func cubicAt(p0, p1, p2, p3 Point, t float64) Point {
+	mt := 1 - t
+	at := func(v0, v1, v2, v3 float32) float32 {
+		return float32(mt*mt*mt*float64(v0) + 3*mt*mt*t*float64(v1) + 3*mt*t*t*float64(v2) + t*t*t*float64(v3))
+	}
+
+	return Point{X: at(p0.X, p1.X, p2.X, p3.X), Y: at(p0.Y, p1.Y, p2.Y, p3.Y)}
+}
+
+func cubicBounds(b Box, p0, p1, p2, p3 Point) Box {
+	b = b.add(p0).add(p3)
+	for _, t := range cubicExtrema(p0.X, p1.X, p2.X, p3.X) {
+		b = b.add(cubicAt(p0, p1, p2, p3, t))
+	}
+	for _, t := range cubicExtrema(p0.Y, p1.Y, p2.Y, p3.Y) {
+		b = b.add(cubicAt(p0, p1, p2, p3, t))
+	}
+
+	return b
+}
+
+// curvesBounds returns the bounds of the pathes made of curves after mapping
+// them with m, which keeps them cubic curves.
+func curvesBounds(b Box, curves []Curve, closed bool, m Matrix) Box {
+	if len(curves) == 0 {
+		return b
+	}
+
+	mapped := make([]Curve, len(curves))
+	for i, c := range curves {
+		mapped[i] = Curve{PointIn: m.Apply(c.PointIn), Point: m.Apply(c.Point), PointOut: m.Apply(c.PointOut)}
+	}
+
+	b = b.add(mapped[0].Point)
+	for i := 1; i < len(mapped); i++ {
+		b = cubicBounds(b, mapped[i-1].Point, mapped[i-1].PointOut, mapped[i].PointIn, mapped[i].Point)
+	}
+	if closed {
+		last, first := mapped[len(mapped)-1], mapped[0]
+		b = cubicBounds(b, last.Point, last.PointOut, first.PointIn, first.Point)
+	}
+
+	return b
+}
+
+// Bounds returns the exact bounds of the path outline, which is empty for
+// pathes without points.
+func (p *Path) Bounds() Box {
+	return curvesBounds(emptyBox(), p.Curves(), p.isClosed, Identity())
+}
+
+// strokeExtent returns how far a stroke reaches from the path. It is exact for
+// round and bevel joins with round and butt caps, otherwise it is an upper
+// bound.
+func strokeExtent(t *TransformerStroke) float32 {
+	d := t.Width / 2
+	if t.LineCap == SquareCap {
+		d *= math.Sqrt2
+	}
+	if t.LineJoin == MiterJoin || t.LineJoin == MiterJoinRevert || t.LineJoin == MiterJoinRound {
+		d *= max(t.MiterLimit, 1)
+	}
+
+	return max(d, 0)
+}
+
+// Bounds returns the bounds of the shape on the canvas, after every
+// transformer. Past stroke, contour and perspective transformers the bounds
+// are mapped as a box, so they are only an upper bound.
+func (s *Shape) Bounds() Box {
+	_, header, list := s.splitTransforms()
+
+	b := emptyBox()
+	m := Identity()
+	exact := true
+	flatten := func() {
+		if exact {
+			for _, p := range s.paths {
+				b = curvesBounds(b, p.Curves(), p.isClosed, m)
+			}
+			exact = false
+		}
+	}
+
+	for _, t := range list {
+		switch t := t.(type) {
+		case *TransformerAffine:
+			if exact {
+				m = m.Multiply(Matrix(t.Matrix))
+			} else {
+				b = b.transform(t)
+			}
+		case *TransformerPerspective:
+			flatten()
+			b = b.transform(t)
+		case *TransformerStroke:
+			flatten()
+			b = b.expand(strokeExtent(t))
+		case *TransformerContour:
+			flatten()
+			b = b.expand(max(t.Width, 0))
+		}
+	}
+
+	if exact {
+		m = m.Multiply(shapeMatrix(header))
+		flatten()
+
+		return b
+	}
+
+	return b.transform(shapeMatrix(header))
+}
+
+// Bounds returns the bounds of all the shapes of the image.
+func (i *Image) Bounds() Box {
+	b := emptyBox()
+	for _, sp := range i.shapes {
+		if sp.Opaque == nil {
+			b = b.Union(sp.Bounds())
+		}
+	}
+
+	return b
+}
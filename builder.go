@@ -0,0 +1,187 @@
+package hvif
+
+import (
+	"errors"
+	"math"
+)
+
+// Distance of the handles approximating a quarter of a circle with a cubic
+// curve, relative to the radius.
+const circleHandle = 0.5522848
+
+// PathBuilder assembles a path from drawing commands. Pathes are made of a
+// single contour, which starts at the first point.
+type PathBuilder struct {
+	path    Path
+	current Point
+	err     error
+}
+
+func NewPathBuilder() *PathBuilder {
+	return &PathBuilder{}
+}
+
+func (b *PathBuilder) add(e PathElement, p Point) *PathBuilder {
+	b.path.Elements = append(b.path.Elements, e)
+	b.current = p
+
+	return b
+}
+
+// draw adds an element of a drawing command, which has to follow MoveTo.
+func (b *PathBuilder) draw(e PathElement, p Point) *PathBuilder {
+	if len(b.path.Elements) == 0 && b.err == nil {
+		b.err = errors.New("path is not started, MoveTo has to come first")
+	}
+
+	return b.add(e, p)
+}
+
+// lastCurve turns the last element into a curve, so that its handles can be
+// changed.
+func (b *PathBuilder) lastCurve() *Curve {
+	if len(b.path.Elements) == 0 {
+		return nil
+	}
+	last := &b.path.Elements[len(b.path.Elements)-1]
+	if c, ok := (*last).(*Curve); ok {
+		return c
+	}
+	c := &Curve{PointIn: b.current, Point: b.current, PointOut: b.current}
+	*last = c
+
+	return c
+}
+
+// MoveTo starts the path, it has to be the first command.
+func (b *PathBuilder) MoveTo(p Point) *PathBuilder {
+	if len(b.path.Elements) > 0 {
+		b.err = errors.New("path is already started, it can have only one contour")
+
+		return b
+	}
+
+	return b.add(&Point{X: p.X, Y: p.Y}, p)
+}
+
+func (b *PathBuilder) LineTo(p Point) *PathBuilder {
+	return b.draw(&Point{X: p.X, Y: p.Y}, p)
+}
+
+func (b *PathBuilder) HLineTo(x float32) *PathBuilder {
+	return b.draw(&HLine{X: x}, Point{X: x, Y: b.current.Y})
+}
+
+func (b *PathBuilder) VLineTo(y float32) *PathBuilder {
+	return b.draw(&VLine{Y: y}, Point{X: b.current.X, Y: y})
+}
+
+// CurveTo draws a cubic curve to p, leaving the current point towards out and
+// arriving to p from in.
+func (b *PathBuilder) CurveTo(out, in, p Point) *PathBuilder {
+	if c := b.lastCurve(); c != nil {
+		c.PointOut = out
+	}
+
+	return b.draw(&Curve{PointIn: in, Point: p, PointOut: p}, p)
+}
+
+// SmoothCurveTo is CurveTo leaving the current point in the direction it was
+// arrived to, as in SVG.
+func (b *PathBuilder) SmoothCurveTo(in, p Point) *PathBuilder {
+	out := b.current
+	if c := b.lastCurve(); c != nil {
+		out = Point{X: 2*c.Point.X - c.PointIn.X, Y: 2*c.Point.Y - c.PointIn.Y}
+	}
+
+	return b.CurveTo(out, in, p)
+}
+
+// Close connects the last point to the first one.
+func (b *PathBuilder) Close() *PathBuilder {
+	b.path.isClosed = true
+
+	return b
+}
+
+// Path returns the built path, or the first error made while building it.
+func (b *PathBuilder) Path() (*Path, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	p := b.path
+
+	return clonePath(&p), nil
+}
+
+func Rect(x, y, w, h float32) *Path {
+	p, _ := NewPathBuilder().MoveTo(Point{x, y}).HLineTo(x + w).VLineTo(y + h).HLineTo(x).Close().Path()
+
+	return p
+}
+
+// RoundedRect is a rectangle with corners rounded by r, limited to half of
+// the shortest side.
+func RoundedRect(x, y, w, h, r float32) *Path {
+	r = min(r, w/2, h/2)
+	if r <= 0 {
+		return Rect(x, y, w, h)
+	}
+	k := r * circleHandle
+	right, bottom := x+w, y+h
+
+	return &Path{isClosed: true, Elements: []PathElement{
+		&Curve{PointIn: Point{x + r - k, y}, Point: Point{x + r, y}, PointOut: Point{x + r, y}},
+		&Curve{PointIn: Point{right - r, y}, Point: Point{right - r, y}, PointOut: Point{right - r + k, y}},
+		&Curve{PointIn: Point{right, y + r - k}, Point: Point{right, y + r}, PointOut: Point{right, y + r}},
+		&Curve{PointIn: Point{right, bottom - r}, Point: Point{right, bottom - r}, PointOut: Point{right, bottom - r + k}},
+		&Curve{PointIn: Point{right - r + k, bottom}, Point: Point{right - r, bottom}, PointOut: Point{right - r, bottom}},
+		&Curve{PointIn: Point{x + r, bottom}, Point: Point{x + r, bottom}, PointOut: Point{x + r - k, bottom}},
+		&Curve{PointIn: Point{x, bottom - r + k}, Point: Point{x, bottom - r}, PointOut: Point{x, bottom - r}},
+		&Curve{PointIn: Point{x, y + r}, Point: Point{x, y + r}, PointOut: Point{x, y + r - k}},
+	}}
+}
+
+func Ellipse(cx, cy, rx, ry float32) *Path {
+	kx, ky := rx*circleHandle, ry*circleHandle
+
+	return &Path{isClosed: true, Elements: []PathElement{
+		&Curve{PointIn: Point{cx + rx, cy - ky}, Point: Point{cx + rx, cy}, PointOut: Point{cx + rx, cy + ky}},
+		&Curve{PointIn: Point{cx + kx, cy + ry}, Point: Point{cx, cy + ry}, PointOut: Point{cx - kx, cy + ry}},
+		&Curve{PointIn: Point{cx - rx, cy + ky}, Point: Point{cx - rx, cy}, PointOut: Point{cx - rx, cy - ky}},
+		&Curve{PointIn: Point{cx - kx, cy - ry}, Point: Point{cx, cy - ry}, PointOut: Point{cx + kx, cy - ry}},
+	}}
+}
+
+func Polygon(points ...Point) *Path {
+	b := NewPathBuilder()
+	for i, p := range points {
+		if i == 0 {
+			b.MoveTo(p)
+		} else {
+			b.LineTo(p)
+		}
+	}
+	p, _ := b.Close().Path()
+
+	return p
+}
+
+// Star has n spikes of the outer radius, starting upwards, joined at the
+// inner radius.
+func Star(cx, cy, outer, inner float32, n int) *Path {
+	points := make([]Point, 0, 2*n)
+	for i := range 2 * n {
+		r := outer
+		if i%2 == 1 {
+			r = inner
+		}
+		angle := math.Pi * (float64(i)/float64(n) - 0.5)
+		points = append(points, Point{
+			X: cx + r*float32(math.Cos(angle)),
+			Y: cy + r*float32(math.Sin(angle)),
+		})
+	}
+
+	return Polygon(points...)
+}
@@ -0,0 +1,102 @@
+package hvif
+
+func clonePath(p *Path) *Path {
+	c := &Path{isClosed: p.isClosed}
+	if p.Elements != nil {
+		c.Elements = make([]PathElement, len(p.Elements))
+		for i, e := range p.Elements {
+			if e != nil {
+				c.Elements[i] = e.Clone()
+			}
+		}
+	}
+
+	return c
+}
+
+func cloneOpaque(o *OpaqueRecord) *OpaqueRecord {
+	if o == nil {
+		return nil
+	}
+
+	return o.Clone().(*OpaqueRecord)
+}
+
+// cloner keeps the copies made so far, so that shared styles and pathes stay
+// shared in the copy.
+type cloner struct {
+	styles map[Style]Style
+	pathes map[*Path]*Path
+}
+
+func (c *cloner) style(s Style) Style {
+	if s == nil {
+		return nil
+	}
+	if cs, ok := c.styles[s]; ok {
+		return cs
+	}
+	cs := s.Clone()
+	c.styles[s] = cs
+
+	return cs
+}
+
+func (c *cloner) path(p *Path) *Path {
+	if p == nil {
+		return nil
+	}
+	if cp, ok := c.pathes[p]; ok {
+		return cp
+	}
+	cp := clonePath(p)
+	c.pathes[p] = cp
+
+	return cp
+}
+
+func (c *cloner) shape(sp *Shape) *Shape {
+	cs := &Shape{
+		Hinting: sp.Hinting,
+		style:   c.style(sp.style),
+		Opaque:  cloneOpaque(sp.Opaque),
+	}
+	if sp.paths != nil {
+		cs.paths = make([]*Path, len(sp.paths))
+		for i, p := range sp.paths {
+			cs.paths[i] = c.path(p)
+		}
+	}
+	if sp.Transforms != nil {
+		cs.Transforms = make([]Transformer, len(sp.Transforms))
+		for i, t := range sp.Transforms {
+			if t != nil {
+				cs.Transforms[i] = t.Clone()
+			}
+		}
+	}
+
+	return cs
+}
+
+// Clone returns a deep copy of the image. Shapes of the copy reference the
+// copied styles and pathes.
+func (i *Image) Clone() *Image {
+	c := cloner{
+		styles: make(map[Style]Style, len(i.styles)),
+		pathes: make(map[*Path]*Path, len(i.pathes)),
+	}
+
+	img := &Image{}
+	for _, s := range i.styles {
+		img.styles = append(img.styles, c.style(s))
+	}
+	for _, p := range i.pathes {
+		img.pathes = append(img.pathes, c.path(p))
+	}
+	for _, sp := range i.shapes {
+		img.shapes = append(img.shapes, c.shape(sp))
+	}
+
+	return img
+}
@@ -0,0 +1,252 @@
+package hvif
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+type DecodeOptions struct {
+	// Lenient keeps everything decoded before a failure, reporting it as a
+	// warning.
+	Lenient bool
+
+	// Strict rejects unknown flag bits, unordered gradient offsets, shape
+	// references to missing styles and pathes, records of unknown type and
+	// bytes following the last shape.
+	Strict bool
+
+	// Limits on the decoded content, zero means no limit. MaxElements caps
+	// the elements of all pathes together, MaxTransformers the transforms
+	// of all shapes together.
+	MaxStyles       int
+	MaxPathes       int
+	MaxShapes       int
+	MaxElements     int
+	MaxTransformers int
+}
+
+type decoder struct {
+	r    *byteReader
+	opts DecodeOptions
+	img  *Image
+
+	// Offset of the first byte and references of every decoded shape
+	shapeOffsets []int64
+	shapeRefs    []shapeRefs
+	warnings     []*DecodeError
+
+	elements     int
+	transformers int
+}
+
+// ReadImageWithOptions decodes an image. Problems tolerated because of the
+// options are returned as warnings. Files with a bad header are never
+// accepted.
+func ReadImageWithOptions(r io.Reader, opts DecodeOptions) (*Image, []*DecodeError, error) {
+	return newDecoder(newStreamReader(r), opts).run()
+}
+
+// Decode is a faster alternative to ReadImage for images already in memory.
+func Decode(data []byte) (*Image, error) {
+	img, _, err := DecodeWithOptions(data, DecodeOptions{})
+
+	return img, err
+}
+
+func DecodeWithOptions(data []byte, opts DecodeOptions) (*Image, []*DecodeError, error) {
+	return newDecoder(newByteReader(data), opts).run()
+}
+
+func newDecoder(r *byteReader, opts DecodeOptions) *decoder {
+	return &decoder{
+		r:    r,
+		opts: opts,
+		img:  &Image{},
+	}
+}
+
+func (d *decoder) run() (*Image, []*DecodeError, error) {
+	if err := d.decode(); err != nil {
+		if !d.opts.Lenient || err.Section == SectionHeader {
+			return nil, d.warnings, err
+		}
+		d.warnings = append(d.warnings, err)
+	}
+
+	if err := d.resolveReferences(); err != nil {
+		return nil, d.warnings, err
+	}
+
+	return d.img, d.warnings, nil
+}
+
+func (d *decoder) decode() *DecodeError {
+	magic, err := d.r.readBytes(4)
+	if err != nil {
+		return newDecodeError(d.r.n, SectionHeader, -1, fmt.Errorf("reading magic: %w", err))
+	}
+
+	if string(magic) != "ncif" {
+		return &DecodeError{
+			Section: SectionHeader, Index: -1, Shape: -1,
+			Err: fmt.Errorf("%w: magic should be ncif, found: %s", ErrBadMagic, magic),
+		}
+	}
+
+	styleCount, err := d.r.readUint8()
+	if err != nil {
+		return newDecodeError(d.r.n, SectionStyle, -1, fmt.Errorf("reading styles count: %w", err))
+	}
+	if err := checkLimit("styles", int(styleCount), d.opts.MaxStyles); err != nil {
+		return newDecodeError(d.r.n-1, SectionStyle, -1, err)
+	}
+
+	for i := range styleCount {
+		s, err := readStyle(d.r, d.opts.Strict)
+		if err != nil {
+			return newDecodeError(d.r.n, SectionStyle, int(i), err)
+		}
+		d.img.styles = append(d.img.styles, s)
+	}
+
+	pathCount, err := d.r.readUint8()
+	if err != nil {
+		return newDecodeError(d.r.n, SectionPath, -1, fmt.Errorf("reading pathes count: %w", err))
+	}
+	if err := checkLimit("pathes", int(pathCount), d.opts.MaxPathes); err != nil {
+		return newDecodeError(d.r.n-1, SectionPath, -1, err)
+	}
+
+	for i := range pathCount {
+		offset := d.r.n
+		p, err := readPath(d.r, d.opts.Strict)
+		if err != nil {
+			return newDecodeError(d.r.n, SectionPath, int(i), err)
+		}
+		d.elements += len(p.Elements)
+		if err := checkLimit("path elements", d.elements, d.opts.MaxElements); err != nil {
+			// Element count follows the path flags
+			return &DecodeError{Offset: offset + 1, Section: SectionPath, Index: int(i), Shape: -1, Err: err}
+		}
+		d.img.pathes = append(d.img.pathes, &p)
+	}
+
+	shapeCount, err := d.r.readUint8()
+	if err != nil {
+		return newDecodeError(d.r.n, SectionShape, -1, fmt.Errorf("reading shapes count: %w", err))
+	}
+	if err := checkLimit("shapes", int(shapeCount), d.opts.MaxShapes); err != nil {
+		return newDecodeError(d.r.n-1, SectionShape, -1, err)
+	}
+
+	for i := range shapeCount {
+		offset := d.r.n
+		s, refs, err := readShape(d.r, d.opts.Strict)
+		if err != nil {
+			de := newDecodeError(d.r.n, SectionShape, int(i), err)
+			if d.opts.Strict || i != shapeCount-1 || !d.readOpaqueTail(&s, err) {
+				return de
+			}
+			d.warnings = append(d.warnings, de)
+		}
+		d.transformers += len(s.Transforms)
+		if err := checkLimit("transformers", d.transformers, d.opts.MaxTransformers); err != nil {
+			return &DecodeError{Offset: offset, Section: SectionShape, Index: int(i), Shape: -1, Err: err}
+		}
+		d.img.shapes = append(d.img.shapes, &s)
+		d.shapeOffsets = append(d.shapeOffsets, offset)
+		d.shapeRefs = append(d.shapeRefs, refs)
+	}
+
+	if d.opts.Strict {
+		if _, err := d.r.readUint8(); err == nil {
+			return &DecodeError{Offset: d.r.n - 1, Section: SectionShape, Index: -1, Shape: -1, Err: ErrTrailingData}
+		}
+	}
+
+	return nil
+}
+
+func checkLimit(what string, n, limit int) error {
+	if limit > 0 && n > limit {
+		return fmt.Errorf("%w: %d %s, at most %d allowed", ErrLimitExceeded, n, what, limit)
+	}
+
+	return nil
+}
+
+// readOpaqueTail stores the rest of the data into the record of unknown type
+// the last shape ends with, since its length cannot be determined otherwise.
+func (d *decoder) readOpaqueTail(s *Shape, err error) bool {
+	var rec *OpaqueRecord
+	var te *transformerError
+	switch {
+	case errors.Is(err, ErrUnknownShapeType):
+		rec = s.Opaque
+	case errors.As(err, &te) && te.last && errors.Is(err, ErrUnknownTransformer):
+		rec, _ = s.Transforms[len(s.Transforms)-1].(*OpaqueRecord)
+	}
+	if rec == nil {
+		return false
+	}
+
+	data, err := d.r.readAll()
+	if err != nil {
+		return false
+	}
+	rec.Data = data
+
+	return true
+}
+
+// resolveReferences points the shapes to their styles and pathes. References
+// to missing ones are dropped with a warning, or fail the decoding if it is
+// strict.
+func (d *decoder) resolveReferences() *DecodeError {
+	for shapeID, sp := range d.img.shapes {
+		if sp.Opaque != nil {
+			continue
+		}
+		refs := d.shapeRefs[shapeID]
+		// Style id follows the shape type, path ids follow the path count
+		offset := d.shapeOffsets[shapeID]
+
+		if int(refs.styleID) < len(d.img.styles) {
+			sp.style = d.img.styles[refs.styleID]
+		} else {
+			de := d.referenceError(offset+1, shapeID, fmt.Errorf("%w: style %d", ErrDanglingReference, refs.styleID))
+			if de != nil {
+				return de
+			}
+		}
+
+		if len(refs.pathIDs) > 0 {
+			sp.paths = make([]*Path, 0, len(refs.pathIDs))
+		}
+		for i, pid := range refs.pathIDs {
+			if int(pid) >= len(d.img.pathes) {
+				de := d.referenceError(offset+3+int64(i), shapeID, fmt.Errorf("%w: path %d", ErrDanglingReference, pid))
+				if de != nil {
+					return de
+				}
+				continue
+			}
+			sp.paths = append(sp.paths, d.img.pathes[pid])
+		}
+	}
+
+	return nil
+}
+
+// referenceError returns the error for a dangling reference, or records it as
+// a warning and returns nil unless decoding is strict and not lenient.
+func (d *decoder) referenceError(offset int64, shapeID int, err error) *DecodeError {
+	de := &DecodeError{Offset: offset, Section: SectionShape, Index: shapeID, Shape: -1, Err: err}
+	if d.opts.Strict && !d.opts.Lenient {
+		return de
+	}
+	d.warnings = append(d.warnings, de)
+
+	return nil
+}
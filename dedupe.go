@@ -0,0 +1,76 @@
+package hvif
+
+import (
+	"bytes"
+	"slices"
+)
+
+type DedupeReport struct {
+	Styles int // Number of styles merged into an equal one
+	Pathes int // Number of pathes merged into an equal one
+	Saved  int // Bytes saved in the encoded image
+}
+
+// Dedupe merges styles and pathes equal up to tolerance into the first of
+// them, shapes are changed to use the remaining one. Pathes are compared by
+// their geometry, see Equal. Transformers are stored within their shapes in
+// the file, so there is nothing to share for them.
+func (i *Image) Dedupe(tolerance float32) DedupeReport {
+	var report DedupeReport
+	c := &comparer{tolerance: tolerance}
+
+	styles := make(map[Style]Style)
+	keptStyles := i.styles[:0]
+	for _, s := range i.styles {
+		idx := slices.IndexFunc(keptStyles, func(k Style) bool {
+			return c.style(k, s)
+		})
+		if idx == -1 {
+			keptStyles = append(keptStyles, s)
+			continue
+		}
+		styles[s] = keptStyles[idx]
+		report.Styles++
+
+		var buf bytes.Buffer
+		if err := writeStyle(&buf, s); err == nil {
+			report.Saved += buf.Len()
+		}
+	}
+	clear(i.styles[len(keptStyles):])
+	i.styles = keptStyles
+
+	pathes := make(map[*Path]*Path)
+	keptPathes := i.pathes[:0]
+	for _, p := range i.pathes {
+		idx := slices.IndexFunc(keptPathes, func(k *Path) bool {
+			return c.path(k, p)
+		})
+		if idx == -1 {
+			keptPathes = append(keptPathes, p)
+			continue
+		}
+		pathes[p] = keptPathes[idx]
+		report.Pathes++
+
+		var buf bytes.Buffer
+		if err := writePath(&buf, p); err == nil {
+			report.Saved += buf.Len()
+		}
+	}
+	clear(i.pathes[len(keptPathes):])
+	i.pathes = keptPathes
+
+	for _, sp := range i.shapes {
+		if s, ok := styles[sp.style]; ok {
+			sp.style = s
+		}
+		for pathID, p := range sp.paths {
+			if kp, ok := pathes[p]; ok {
+				sp.paths[pathID] = kp
+			}
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,159 @@
+package hvif
+
+import (
+	"bytes"
+	"slices"
+)
+
+type comparer struct {
+	a, b      *Image
+	tolerance float32
+}
+
+func (c *comparer) float(x, y float32) bool {
+	d := x - y
+	if d < 0 {
+		d = -d
+	}
+
+	return d <= c.tolerance
+}
+
+func (c *comparer) floats(x, y []float32) bool {
+	return slices.EqualFunc(x, y, c.float)
+}
+
+func (c *comparer) point(x, y Point) bool {
+	return c.float(x.X, y.X) && c.float(x.Y, y.Y)
+}
+
+func (c *comparer) affine(x, y *TransformerAffine) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+
+	return c.floats(x.Matrix[:], y.Matrix[:])
+}
+
+func (c *comparer) style(x, y Style) bool {
+	switch x := x.(type) {
+	case *Color:
+		y, ok := y.(*Color)
+
+		return ok && *x == *y
+	case *Gradient:
+		y, ok := y.(*Gradient)
+
+		return ok && x.Type == y.Type && c.affine(x.Transformable, y.Transformable) &&
+			slices.Equal(x.Colors, y.Colors) && slices.Equal(x.Offsets, y.Offsets)
+	}
+
+	return x == nil && y == nil
+}
+
+// path compares the geometry, pathes storing it with different elements are
+// equal.
+func (c *comparer) path(x, y *Path) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+	if x.isClosed != y.isClosed {
+		return false
+	}
+	xNodes, err := resolvePathElements(x.Elements)
+	if err != nil {
+		return false
+	}
+	yNodes, err := resolvePathElements(y.Elements)
+	if err != nil {
+		return false
+	}
+
+	return slices.EqualFunc(xNodes, yNodes, func(xn, yn pathNode) bool {
+		return c.point(xn.In, yn.In) && c.point(xn.Point, yn.Point) && c.point(xn.Out, yn.Out)
+	})
+}
+
+func (c *comparer) transformer(x, y Transformer) bool {
+	switch x := x.(type) {
+	case *TransformerTranslation:
+		y, ok := y.(*TransformerTranslation)
+
+		return ok && c.float(x.X, y.X) && c.float(x.Y, y.Y)
+	case *TransformerLodScale:
+		y, ok := y.(*TransformerLodScale)
+
+		return ok && c.float(x.MinS, y.MinS) && c.float(x.MaxS, y.MaxS)
+	case *TransformerAffine:
+		y, ok := y.(*TransformerAffine)
+
+		return ok && c.affine(x, y)
+	case *TransformerPerspective:
+		y, ok := y.(*TransformerPerspective)
+
+		return ok && c.floats(x.Matrix[:], y.Matrix[:])
+	case *TransformerContour:
+		y, ok := y.(*TransformerContour)
+
+		return ok && x.LineJoin == y.LineJoin && c.float(x.Width, y.Width) && c.float(x.MiterLimit, y.MiterLimit)
+	case *TransformerStroke:
+		y, ok := y.(*TransformerStroke)
+
+		return ok && x.LineJoin == y.LineJoin && x.LineCap == y.LineCap &&
+			c.float(x.Width, y.Width) && c.float(x.MiterLimit, y.MiterLimit)
+	case *OpaqueRecord:
+		y, ok := y.(*OpaqueRecord)
+
+		return ok && c.opaque(x, y)
+	}
+
+	return false
+}
+
+func (c *comparer) opaque(x, y *OpaqueRecord) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+
+	return x.Type == y.Type && bytes.Equal(x.Data, y.Data)
+}
+
+// shapeStyle compares styles by their position in the images, styles which
+// are not part of the images are compared by value.
+func (c *comparer) shapeStyle(x, y Style) bool {
+	xi, yi := slices.Index(c.a.styles, x), slices.Index(c.b.styles, y)
+	if xi >= 0 || yi >= 0 {
+		return xi == yi
+	}
+
+	return c.style(x, y)
+}
+
+func (c *comparer) shapePath(x, y *Path) bool {
+	xi, yi := slices.Index(c.a.pathes, x), slices.Index(c.b.pathes, y)
+	if xi >= 0 || yi >= 0 {
+		return xi == yi
+	}
+
+	return c.path(x, y)
+}
+
+func (c *comparer) shape(x, y *Shape) bool {
+	return x.Hinting == y.Hinting && c.opaque(x.Opaque, y.Opaque) &&
+		c.shapeStyle(x.style, y.style) &&
+		slices.EqualFunc(x.paths, y.paths, c.shapePath) &&
+		slices.EqualFunc(x.Transforms, y.Transforms, c.transformer)
+}
+
+// Equal reports whether two images have the same content. Coordinates,
+// matrices and other real numbers may differ by up to tolerance.
+func Equal(a, b *Image, tolerance float32) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	c := &comparer{a: a, b: b, tolerance: tolerance}
+
+	return slices.EqualFunc(a.styles, b.styles, c.style) &&
+		slices.EqualFunc(a.pathes, b.pathes, c.path) &&
+		slices.EqualFunc(a.shapes, b.shapes, c.shape)
+}
@@ -0,0 +1,115 @@
+package hvif
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrBadMagic           = errors.New("bad magic")
+	ErrUnknownStyleType   = errors.New("unknown style type")
+	ErrUnknownTransformer = errors.New("unknown transformer")
+	ErrUnknownShapeType   = errors.New("unknown shape type")
+	ErrTruncated          = errors.New("truncated data")
+	ErrDanglingReference  = errors.New("dangling reference")
+
+	// Returned in strict mode or when limits are set
+	ErrUnknownFlags     = errors.New("unknown flags")
+	ErrUnorderedOffsets = errors.New("gradient offsets are not ordered")
+	ErrLimitExceeded    = errors.New("limit exceeded")
+	ErrTrailingData     = errors.New("trailing data")
+)
+
+// Section is a part of the file an element belongs to.
+type Section uint8
+
+const (
+	SectionHeader Section = iota
+	SectionStyle
+	SectionPath
+	SectionShape
+	SectionTransformer
+)
+
+func (s Section) String() string {
+	switch s {
+	case SectionHeader:
+		return "header"
+	case SectionStyle:
+		return "style"
+	case SectionPath:
+		return "path"
+	case SectionShape:
+		return "shape"
+	case SectionTransformer:
+		return "transformer"
+	}
+
+	return fmt.Sprintf("section %d", uint8(s))
+}
+
+// DecodeError describes where decoding failed. The cause can be matched with
+// errors.Is against the Err* sentinels.
+type DecodeError struct {
+	Offset  int64 // Offset of the offending byte, or of the missing one if truncated
+	Section Section
+	Index   int // Index of the element within its section, -1 for counts and magic
+	Shape   int // Index of the shape owning a transformer, -1 otherwise
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	switch {
+	case e.Index < 0:
+		return fmt.Sprintf("decoding %s at offset %d: %v", e.Section, e.Offset, e.Err)
+	case e.Shape >= 0:
+		return fmt.Sprintf("decoding %s [%d] of shape [%d] at offset %d: %v", e.Section, e.Index, e.Shape, e.Offset, e.Err)
+	default:
+		return fmt.Sprintf("decoding %s [%d] at offset %d: %v", e.Section, e.Index, e.Offset, e.Err)
+	}
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// transformerError marks failures of the shape transformers list, so that
+// they are reported in the transformer section.
+type transformerError struct {
+	index int
+	last  bool // Whether it is the last transformer of the shape
+	err   error
+}
+
+func (e *transformerError) Error() string {
+	return fmt.Sprintf("reading transformer [%d]: %v", e.index, e.err)
+}
+
+func (e *transformerError) Unwrap() error {
+	return e.err
+}
+
+// newDecodeError builds a DecodeError for a failure detected after offset
+// bytes were consumed.
+func newDecodeError(offset int64, section Section, index int, err error) *DecodeError {
+	de := &DecodeError{Offset: offset, Section: section, Index: index, Shape: -1, Err: err}
+
+	var te *transformerError
+	if section == SectionShape && errors.As(err, &te) {
+		de.Section = SectionTransformer
+		de.Shape = index
+		de.Index = te.index
+	}
+
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		de.Err = fmt.Errorf("%w: %w", ErrTruncated, err)
+	case errors.Is(err, ErrUnknownStyleType), errors.Is(err, ErrUnknownTransformer), errors.Is(err, ErrUnknownShapeType),
+		errors.Is(err, ErrUnknownFlags), errors.Is(err, ErrUnorderedOffsets):
+		// The rejected byte is the last one consumed
+		de.Offset--
+	}
+
+	return de
+}
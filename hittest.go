@@ -0,0 +1,244 @@
+package hvif
+
+import "math"
+
+// Number of segments a curve is split to for hit testing
+const curveSegments = 16
+
+// polyline is a flattened path.
+type polyline struct {
+	points []Point
+	closed bool
+}
+
+func flattenPath(p *Path) polyline {
+	curves := p.Curves()
+	pl := polyline{closed: p.isClosed}
+	if len(curves) == 0 {
+		return pl
+	}
+
+	pl.points = append(pl.points, curves[0].Point)
+	segment := func(from, to Curve) {
+		if from.PointOut == from.Point && to.PointIn == to.Point {
+			pl.points = append(pl.points, to.Point)
+
+			return
+		}
+		for i := 1; i <= curveSegments; i++ {
+			t := float64(i) / curveSegments
+			pl.points = append(pl.points, cubicAt(from.Point, from.PointOut, to.PointIn, to.Point, t))
+		}
+	}
+	for i := 1; i < len(curves); i++ {
+		segment(curves[i-1], curves[i])
+	}
+	if pl.closed && len(curves) > 1 {
+		segment(curves[len(curves)-1], curves[0])
+		// The first point is repeated by the closing segment
+		pl.points = pl.points[:len(pl.points)-1]
+	}
+
+	return pl
+}
+
+// winding returns the winding number of the polyline, closed for filling,
+// around p.
+func (pl polyline) winding(p Point) int {
+	n := 0
+	for i := range pl.points {
+		a, b := pl.points[i], pl.points[(i+1)%len(pl.points)]
+		cross := (b.X-a.X)*(p.Y-a.Y) - (p.X-a.X)*(b.Y-a.Y)
+		switch {
+		case a.Y <= p.Y && b.Y > p.Y && cross > 0:
+			n++
+		case a.Y > p.Y && b.Y <= p.Y && cross < 0:
+			n--
+		}
+	}
+
+	return n
+}
+
+func segmentDistance(p, a, b Point) float64 {
+	dx, dy := float64(b.X-a.X), float64(b.Y-a.Y)
+	px, py := float64(p.X-a.X), float64(p.Y-a.Y)
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = max(0, min(1, (px*dx+py*dy)/l))
+	}
+
+	return math.Hypot(px-t*dx, py-t*dy)
+}
+
+// distance returns the distance from p to the polyline, including the
+// closing segment if closing is set or the polyline is closed.
+func (pl polyline) distance(p Point, closing bool) float64 {
+	d := math.Inf(1)
+	for i := 1; i < len(pl.points); i++ {
+		d = min(d, segmentDistance(p, pl.points[i-1], pl.points[i]))
+	}
+	if len(pl.points) == 1 {
+		d = segmentDistance(p, pl.points[0], pl.points[0])
+	}
+	if (closing || pl.closed) && len(pl.points) > 2 {
+		d = min(d, segmentDistance(p, pl.points[len(pl.points)-1], pl.points[0]))
+	}
+
+	return d
+}
+
+func (pl polyline) transform(t Transformer) {
+	for i, p := range pl.points {
+		pl.points[i] = t.Apply(p)
+	}
+}
+
+// invertPerspective returns the inverse of the projective transformation,
+// stored in the TransformerPerspective layout.
+func invertPerspective(t *TransformerPerspective) (*TransformerPerspective, bool) {
+	m := t.Matrix
+	// Cofactors of the matrix with columns (m0, m1, m2), (m3, m4, m5), (m6, m7, m8)
+	c := [perspectiveMatrixSize]float32{
+		m[4]*m[8] - m[5]*m[7],
+		m[2]*m[7] - m[1]*m[8],
+		m[1]*m[5] - m[2]*m[4],
+		m[5]*m[6] - m[3]*m[8],
+		m[0]*m[8] - m[2]*m[6],
+		m[2]*m[3] - m[0]*m[5],
+		m[3]*m[7] - m[4]*m[6],
+		m[1]*m[6] - m[0]*m[7],
+		m[0]*m[4] - m[1]*m[3],
+	}
+	det := m[0]*c[0] + m[3]*c[1] + m[6]*c[2]
+	if det == 0 {
+		return nil, false
+	}
+
+	// Scaling does not matter for projective transformations
+	return &TransformerPerspective{Matrix: c}, true
+}
+
+// hit tells whether the shape covers p, given in canvas coordinates.
+// Transformers are applied to the flattened pathes up to the first stroke or
+// contour one. The point is mapped back through the remaining ones, which
+// change the outline by the distance of the point to it.
+func (s *Shape) hit(p Point) bool {
+	_, header, list := s.splitTransforms()
+
+	outline := len(list)
+	for i, t := range list {
+		if k := t.Kind(); k == TransformerKindStroke || k == TransformerKindContour {
+			outline = i
+			break
+		}
+	}
+
+	// Map the point back to the space of the outline
+	rest := append(list[outline:len(list):len(list)], &TransformerAffine{Matrix: shapeMatrix(header)})
+	for i := len(rest) - 1; i >= 0; i-- {
+		switch t := rest[i].(type) {
+		case *TransformerTranslation:
+			p = Point{X: p.X - t.X, Y: p.Y - t.Y}
+		case *TransformerAffine:
+			inv, ok := Matrix(t.Matrix).Invert()
+			if !ok {
+				return false
+			}
+			p = inv.Apply(p)
+		case *TransformerPerspective:
+			inv, ok := invertPerspective(t)
+			if !ok {
+				return false
+			}
+			p = inv.Apply(p)
+		}
+	}
+
+	lines := make([]polyline, 0, len(s.paths))
+	winding := 0
+	for _, path := range s.paths {
+		pl := flattenPath(path)
+		if len(pl.points) == 0 {
+			continue
+		}
+		for _, t := range list[:outline] {
+			pl.transform(t)
+		}
+		winding += pl.winding(p)
+		lines = append(lines, pl)
+	}
+	if outline == len(list) {
+		return winding != 0
+	}
+
+	// Signed distance to the filled area, negative inside of it
+	fill, stroke := math.Inf(1), math.Inf(1)
+	for _, pl := range lines {
+		fill = min(fill, pl.distance(p, true))
+		stroke = min(stroke, pl.distance(p, false))
+	}
+	d := fill
+	if winding != 0 {
+		d = -d
+	}
+
+	for i, t := range rest[:len(rest)-1] {
+		switch t := t.(type) {
+		case *TransformerStroke:
+			if i == 0 {
+				d = stroke
+			}
+			d = math.Abs(d) - float64(t.Width)/2
+		case *TransformerContour:
+			d -= float64(t.Width)
+		case *TransformerAffine:
+			d *= math.Sqrt(math.Abs(float64(Matrix(t.Matrix).determinant())))
+		}
+	}
+
+	return d <= 0
+}
+
+// hitAt tells whether the shape is drawn at the render scale and covers p.
+func (s *Shape) hitAt(p Point, scale float32) bool {
+	return s.Opaque == nil && s.VisibleAt(scale) && s.hit(p)
+}
+
+// ShapesAt returns the shapes covering the point at the 64x64 size, from the
+// topmost one. See ShapesAtScale for other sizes.
+func (i *Image) ShapesAt(x, y float32) []*Shape {
+	return i.ShapesAtScale(x, y, 1)
+}
+
+// ShapeAt returns the topmost shape covering the point at the 64x64 size.
+func (i *Image) ShapeAt(x, y float32) *Shape {
+	return i.ShapeAtScale(x, y, 1)
+}
+
+// ShapesAtScale returns the shapes covering the point at the render scale, 1
+// being the 64x64 size, from the topmost one. Shapes hidden at the scale by
+// their level of detail are skipped. The point is in canvas coordinates, it
+// is not scaled.
+func (i *Image) ShapesAtScale(x, y, scale float32) []*Shape {
+	var res []*Shape
+	for shapeID := len(i.shapes) - 1; shapeID >= 0; shapeID-- {
+		if sp := i.shapes[shapeID]; sp.hitAt(Point{X: x, Y: y}, scale) {
+			res = append(res, sp)
+		}
+	}
+
+	return res
+}
+
+// ShapeAtScale returns the topmost shape covering the point, see
+// ShapesAtScale.
+func (i *Image) ShapeAtScale(x, y, scale float32) *Shape {
+	for shapeID := len(i.shapes) - 1; shapeID >= 0; shapeID-- {
+		if sp := i.shapes[shapeID]; sp.hitAt(Point{X: x, Y: y}, scale) {
+			return sp
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package hvif
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -14,61 +15,72 @@ type Image struct {
 }
 
 func ReadImage(r io.Reader) (*Image, error) {
-	img := &Image{}
+	img, _, err := ReadImageWithOptions(r, DecodeOptions{})
 
-	magic := make([]uint8, 4)
-	_, err := io.ReadFull(r, magic)
-	if err != nil {
-		return nil, fmt.Errorf("reading magic: %w", err)
+	return img, err
+}
+
+// WriteImage fails with an *InvalidImageError if the image has problems other
+// than warnings.
+func WriteImage(w io.Writer, img *Image) error {
+	var invalid []Problem
+	for _, p := range img.Validate() {
+		if !p.Warning {
+			invalid = append(invalid, p)
+		}
+	}
+	if len(invalid) > 0 {
+		return &InvalidImageError{Problems: invalid}
 	}
 
-	if string(magic) != "ncif" {
-		return nil, fmt.Errorf("magic should be ncif, found: %s", magic)
+	if _, err := io.WriteString(w, "ncif"); err != nil {
+		return fmt.Errorf("writing magic: %w", err)
 	}
 
-	var styleCount uint8
-	err = binary.Read(r, binary.LittleEndian, &styleCount)
+	err := binary.Write(w, binary.LittleEndian, uint8(len(img.styles)))
 	if err != nil {
-		return nil, fmt.Errorf("reading styles count: %w", err)
+		return fmt.Errorf("writing styles count: %w", err)
 	}
 
-	for i := range styleCount {
-		s, err := readStyle(r)
-		if err != nil {
-			return nil, fmt.Errorf("reading style [%d]: %w", i, err)
+	for i, s := range img.styles {
+		if err := writeStyle(w, s); err != nil {
+			return fmt.Errorf("writing style [%d]: %w", i, err)
 		}
-		img.styles = append(img.styles, s)
 	}
 
-	var pathCount uint8
-	err = binary.Read(r, binary.LittleEndian, &pathCount)
+	err = binary.Write(w, binary.LittleEndian, uint8(len(img.pathes)))
 	if err != nil {
-		return nil, fmt.Errorf("reading pathes count: %w", err)
+		return fmt.Errorf("writing pathes count: %w", err)
 	}
 
-	for i := range pathCount {
-		p, err := readPath(r)
-		if err != nil {
-			return nil, fmt.Errorf("reading path [%d]: %w", i, err)
+	for i, p := range img.pathes {
+		if err := writePath(w, p); err != nil {
+			return fmt.Errorf("writing path [%d]: %w", i, err)
 		}
-		img.pathes = append(img.pathes, &p)
 	}
 
-	var shapeCount uint8
-	err = binary.Read(r, binary.LittleEndian, &shapeCount)
+	err = binary.Write(w, binary.LittleEndian, uint8(len(img.shapes)))
 	if err != nil {
-		return nil, fmt.Errorf("reading shapes count: %w", err)
+		return fmt.Errorf("writing shapes count: %w", err)
 	}
 
-	for i := range shapeCount {
-		s, err := readShape(r)
-		if err != nil {
-			return nil, fmt.Errorf("reading shape [%d]: %w", i, err)
+	idx := newShapeIndex(img)
+	for i, sp := range img.shapes {
+		if err := writeShape(w, sp, idx); err != nil {
+			return fmt.Errorf("writing shape [%d]: %w", i, err)
 		}
-		img.shapes = append(img.shapes, &s)
 	}
 
-	return img, nil
+	return nil
+}
+
+func (i *Image) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := WriteImage(&buf, i); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
 
 func (i *Image) GetStyles() []Style {
@@ -83,18 +95,27 @@ func (i *Image) GetShapes() []*Shape {
 	return i.shapes
 }
 
+// GetShapeStyle returns nil if the shape has no style or its style is not in
+// the image.
 func (i *Image) GetShapeStyle(s *Shape) Style {
-	if s.styleID == nil {
+	if s == nil || s.style == nil || !slices.Contains(i.styles, s.style) {
 		return nil
 	}
 
-	return i.styles[*s.styleID]
+	return s.style
 }
 
+// GetShapePathes skips pathes which are not in the image.
 func (i *Image) GetShapePathes(s *Shape) []*Path {
-	res := make([]*Path, 0, len(s.pathIDs))
-	for pid := range s.pathIDs {
-		res = append(res, i.pathes[pid])
+	if s == nil {
+		return nil
+	}
+
+	res := make([]*Path, 0, len(s.paths))
+	for _, p := range s.paths {
+		if slices.Contains(i.pathes, p) {
+			res = append(res, p)
+		}
 	}
 
 	return res
@@ -112,6 +133,7 @@ func (i *Image) AddShape(sp *Shape) {
 	i.shapes = append(i.shapes, sp)
 }
 
+// RemoveStyle also unsets it from the shapes using it.
 func (i *Image) RemoveStyle(s Style) {
 	styleID := slices.Index(i.styles, s)
 	if styleID == -1 {
@@ -120,16 +142,13 @@ func (i *Image) RemoveStyle(s Style) {
 	i.styles = slices.Delete(i.styles, styleID, styleID+1)
 
 	for _, sp := range i.shapes {
-		// Shift style by one
-		if sp.styleID != nil && *sp.styleID > uint8(styleID) {
-			*sp.styleID--
-		}
-		if sp.styleID != nil && *sp.styleID == uint8(styleID) {
-			sp.styleID = nil
+		if sp.style == s {
+			sp.style = nil
 		}
 	}
 }
 
+// RemovePath also removes it from the shapes using it.
 func (i *Image) RemovePath(p *Path) {
 	pathID := slices.Index(i.pathes, p)
 	if pathID == -1 {
@@ -138,17 +157,7 @@ func (i *Image) RemovePath(p *Path) {
 	i.pathes = slices.Delete(i.pathes, pathID, pathID+1)
 
 	for _, sp := range i.shapes {
-		// TODO: Optimize to 0 allocs?
-		newPathIDs := make([]uint8, 0, len(sp.pathIDs))
-		for _, pid := range sp.pathIDs {
-			if pid != uint8(pathID) {
-				if pid > uint8(pathID) {
-					pid--
-				}
-				newPathIDs = append(newPathIDs, pid)
-			}
-		}
-		sp.pathIDs = newPathIDs
+		sp.RemovePath(p)
 	}
 }
 
@@ -159,3 +168,61 @@ func (i *Image) RemoveShape(sp *Shape) {
 	}
 	i.shapes = slices.Delete(i.shapes, shapeID, shapeID+1)
 }
+
+// move places item at index, shifting the items in between. Indices out of
+// range are clamped.
+func move[T comparable](items []T, item T, index int) {
+	from := slices.Index(items, item)
+	if from == -1 {
+		return
+	}
+	index = max(0, min(index, len(items)-1))
+
+	switch {
+	case from < index:
+		copy(items[from:index], items[from+1:index+1])
+	case from > index:
+		copy(items[index+1:from+1], items[index:from])
+	}
+	items[index] = item
+}
+
+// MoveShape changes the position of the shape in the drawing order, shapes
+// with greater indices are drawn on top.
+func (i *Image) MoveShape(sp *Shape, index int) {
+	move(i.shapes, sp, index)
+}
+
+// RaiseShape moves the shape one step up in the drawing order.
+func (i *Image) RaiseShape(sp *Shape) {
+	if shapeID := slices.Index(i.shapes, sp); shapeID != -1 {
+		move(i.shapes, sp, shapeID+1)
+	}
+}
+
+// LowerShape moves the shape one step down in the drawing order.
+func (i *Image) LowerShape(sp *Shape) {
+	if shapeID := slices.Index(i.shapes, sp); shapeID > 0 {
+		move(i.shapes, sp, shapeID-1)
+	}
+}
+
+// ToFront makes the shape drawn last.
+func (i *Image) ToFront(sp *Shape) {
+	move(i.shapes, sp, len(i.shapes)-1)
+}
+
+// ToBack makes the shape drawn first.
+func (i *Image) ToBack(sp *Shape) {
+	move(i.shapes, sp, 0)
+}
+
+// MoveStyle changes the position of the style, shapes keep using it.
+func (i *Image) MoveStyle(s Style, index int) {
+	move(i.styles, s, index)
+}
+
+// MovePath changes the position of the path, shapes keep using it.
+func (i *Image) MovePath(p *Path, index int) {
+	move(i.pathes, p, index)
+}
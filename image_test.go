@@ -1,9 +1,15 @@
 package hvif
 
 import (
+	"bytes"
+	"errors"
+	"math"
 	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,14 +30,32 @@ func asserPointsAreEqual(t *testing.T, e, a Point, msg any) {
 	assert.InDelta(t, e.Y, a.Y, 0.1, msg)
 }
 
-func getPointer(x uint8) *uint8 {
-	return &x
+// headerApply maps a point with the shape matrix.
+func headerApply(sp *Shape, p Point) Point {
+	_, header, _ := sp.splitTransforms()
+	for _, t := range header {
+		p = t.Apply(p)
+	}
+
+	return p
+}
+
+// shapeIndices returns the indices of the style and pathes of a shape.
+func shapeIndices(img *Image, sp *Shape) (int, []int) {
+	pathIDs := make([]int, 0, len(sp.paths))
+	for _, p := range sp.paths {
+		pathIDs = append(pathIDs, slices.Index(img.pathes, p))
+	}
+
+	return slices.Index(img.styles, sp.style), pathIDs
 }
 
 func TestRead(t *testing.T) {
 	testdata := []struct {
-		file  string
-		image *Image
+		file        string
+		image       *Image
+		shapeStyles []int
+		shapePathes [][]int
 	}{
 		{
 			"testdata/ime.hvif",
@@ -45,7 +69,7 @@ func TestRead(t *testing.T) {
 							{Red: 168, Green: 120, Blue: 4, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.25, -0.125, 0.25, 0.5, 16.0, 8.0},
+							Matrix: [6]float32{0.4796, -0.1693, 0.2867, 0.8122, 17.2386, 9.7458},
 						},
 					},
 					&Gradient{Type: GradientLinear, Offsets: []uint8{0, 255},
@@ -54,7 +78,7 @@ func TestRead(t *testing.T) {
 							{Red: 246, Green: 197, Blue: 79, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.25, -0.125, 0.25, 0.5, 16.0, 8.0},
+							Matrix: [6]float32{0.4796, -0.1693, 0.2867, 0.8122, 17.2386, 9.7458},
 						},
 					},
 					&Gradient{Type: GradientLinear, Offsets: []uint8{0, 254},
@@ -63,7 +87,7 @@ func TestRead(t *testing.T) {
 							{Red: 202, Green: 154, Blue: 37, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.25, -0.0625, 0.25, 0.5, 16.0, 4.0},
+							Matrix: [6]float32{0.2892, -0.1021, 0.2867, 0.8122, 29.4264, 5.4443},
 						},
 					},
 					&Gradient{Type: GradientCircular, Offsets: []uint8{0, 185, 255},
@@ -73,7 +97,7 @@ func TestRead(t *testing.T) {
 							{Red: 151, Green: 8, Blue: 179, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.125, 0.0, 0.0, 0.0625, 32.0, 16.0},
+							Matrix: [6]float32{0.15625, 0.0, 0.0, 0.109375, 39.0, 30.0},
 						},
 					},
 					&Gradient{Type: GradientCircular, Offsets: []uint8{0, 185, 255},
@@ -83,7 +107,7 @@ func TestRead(t *testing.T) {
 							{Red: 20, Green: 107, Blue: 2, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.125, 0.0, 0.0, 0.0625, 32.0, 16.0},
+							Matrix: [6]float32{0.15625, 0.0, 0.0, 0.109375, 39.0, 30.0},
 						},
 					},
 					&Gradient{Type: GradientCircular, Offsets: []uint8{0, 185, 255},
@@ -93,7 +117,7 @@ func TestRead(t *testing.T) {
 							{Red: 8, Green: 64, Blue: 179, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.125, 0.0, 0.0, 0.0625, 32.0, 16.0},
+							Matrix: [6]float32{0.15625, 0.0, 0.0, 0.109375, 39.0, 30.0},
 						},
 					},
 					&Gradient{Type: GradientCircular, Offsets: []uint8{0, 185, 255},
@@ -103,7 +127,7 @@ func TestRead(t *testing.T) {
 							{Red: 179, Green: 9, Blue: 9, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.125, 0.0, 0.0, 0.0625, 32.0, 16.0},
+							Matrix: [6]float32{0.15625, 0.0, 0.0, 0.109375, 39.0, 30.0},
 						},
 					},
 					&Gradient{Type: GradientCircular, Offsets: []uint8{0, 255},
@@ -112,7 +136,7 @@ func TestRead(t *testing.T) {
 							{Red: 53, Green: 53, Blue: 53, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.03, 0.0, 0.0, 0.25, 32.0, 16.0},
+							Matrix: [6]float32{0.03125, 0.0, 0.0, 0.25, 35.0, 30.0},
 						},
 					},
 					&Gradient{Type: GradientLinear, Offsets: []uint8{0, 255},
@@ -121,7 +145,7 @@ func TestRead(t *testing.T) {
 							{Red: 124, Green: 147, Blue: 177, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{-0.03, 0.0, 0.0, 1.0, 32.0, 0.0},
+							Matrix: [6]float32{-0.03125, 0.0, 0.0, 1.0, 34.0, 0.0},
 						},
 					},
 					&Gradient{Type: GradientCircular, Offsets: []uint8{0, 255},
@@ -130,7 +154,7 @@ func TestRead(t *testing.T) {
 							{Red: 255, Green: 5, Blue: 5, Alpha: 0},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.25, 0.0, 0.0, 0.125, 32.0, 0.0},
+							Matrix: [6]float32{0.46875, 0.0, 0.0, 0.15625, 34.0, 0.0},
 						},
 					},
 					&Gradient{Type: GradientCircular, Offsets: []uint8{0, 255},
@@ -139,7 +163,7 @@ func TestRead(t *testing.T) {
 							{Red: 160, Green: 109, Blue: 30, Alpha: 255},
 						},
 						Transformable: &TransformerAffine{
-							Matrix: [6]float32{0.06, -0.06, 0.06, 0.06, 32.0, 4.0},
+							Matrix: [6]float32{0.0913, -0.0646, 0.0733, 0.1037, 37.884, 5.3199},
 						},
 					},
 				},
@@ -148,32 +172,33 @@ func TestRead(t *testing.T) {
 						isClosed: true, Elements: []PathElement{
 							&Curve{PointIn: Point{18, 22}, Point: Point{18, 22}, PointOut: Point{18, 22}},
 							&Curve{PointIn: Point{18, 56}, Point: Point{18, 56}, PointOut: Point{34, 56}},
-							&Curve{PointIn: Point{38, 44}, Point: Point{34, 48}, PointOut: Point{38, 44}},
-							&Curve{PointIn: Point{44, 46}, Point: Point{40, 46}, PointOut: Point{48, 46}},
-							&Curve{PointIn: Point{55, 45}, Point: Point{54, 46}, PointOut: Point{56, 44}},
-							&Curve{PointIn: Point{64, 42}, Point: Point{64, 45}, PointOut: Point{64, 40}},
-							&Curve{PointIn: Point{61, 39}, Point: Point{60, 40}, PointOut: Point{61, 39}},
-							&Curve{PointIn: Point{62, 34}, Point: Point{62, 37}, PointOut: Point{62, 28}},
-							&Curve{PointIn: Point{50, 22}, Point: Point{58, 26}, PointOut: Point{50, 22}},
+							&Curve{PointIn: Point{34, 48}, Point: Point{38, 44}, PointOut: Point{38, 44}},
+							&Curve{PointIn: Point{40, 46}, Point: Point{44, 46}, PointOut: Point{48, 46}},
+							&Curve{PointIn: Point{54, 46}, Point: Point{55, 45}, PointOut: Point{56, 44}},
+							&Curve{PointIn: Point{64, 45}, Point: Point{64, 42}, PointOut: Point{64, 40}},
+							&Curve{PointIn: Point{60, 40}, Point: Point{61, 39}, PointOut: Point{61, 39}},
+							&Curve{PointIn: Point{62, 37}, Point: Point{62, 34}, PointOut: Point{62, 28}},
+							&Curve{PointIn: Point{58, 26}, Point: Point{50, 22}, PointOut: Point{50, 22}},
 						},
 					},
 					{
 						isClosed: true, Elements: []PathElement{
-							&Curve{PointIn: Point{2, 38}, Point: Point{2, 24}, PointOut: Point{2, 48}},
-							&Curve{PointIn: Point{18, 52}, Point: Point{12, 52}, PointOut: Point{30, 52}},
-							&Curve{PointIn: Point{33, 41}, Point: Point{29, 45}, PointOut: Point{37, 37}},
-							&Curve{PointIn: Point{44, 42}, Point: Point{39, 42}, PointOut: Point{54, 42}},
-							&Curve{PointIn: Point{58, 28}, Point: Point{58, 36}, PointOut: Point{58, 20}},
-							&Curve{PointIn: Point{38, 14}, Point: Point{48, 14}, PointOut: Point{20, 14}},
+							&Curve{PointIn: Point{2, 24}, Point: Point{2, 38}, PointOut: Point{2, 48}},
+							&Curve{PointIn: Point{12, 52}, Point: Point{18, 52}, PointOut: Point{30, 52}},
+							&Curve{PointIn: Point{29, 45}, Point: Point{33, 41}, PointOut: Point{37, 37}},
+							&Curve{PointIn: Point{39, 42}, Point: Point{44, 42}, PointOut: Point{54, 42}},
+							&Curve{PointIn: Point{58, 36}, Point: Point{58, 28}, PointOut: Point{58, 20}},
+							&Curve{PointIn: Point{48, 14}, Point: Point{38, 14}, PointOut: Point{20, 14}},
 						},
 					},
 				},
 				shapes: []*Shape{
-					{Hinting: false, styleID: getPointer(0), pathIDs: []uint8{0}, Transforms: nil},
-					{Hinting: false, styleID: getPointer(1), pathIDs: []uint8{3, 4, 5},
-						Transforms: []Transformer{&TransformerStroke{Width: 4, LineJoin: MiterJoin, LineCap: ButtCap, MiterLimit: 4}}},
+					{Hinting: false, Transforms: nil},
+					{Hinting: false, Transforms: []Transformer{&TransformerStroke{Width: 4, LineJoin: MiterJoin, LineCap: ButtCap, MiterLimit: 4}}},
 				},
 			},
+			[]int{0, 1},
+			[][]int{{0}, {3, 4, 5}},
 		},
 	}
 
@@ -255,11 +280,9 @@ func TestRead(t *testing.T) {
 			assert.Equal(t, reflect.TypeOf(aShapes[i]), reflect.TypeOf(aShapes[i]), i)
 
 			assert.Equal(t, aShapes[i].Hinting, eShapes[i].Hinting, i)
-			assert.True(t, isNilOrObject(aShapes[i].styleID, eShapes[i].styleID), i)
-			if aShapes[i].styleID != nil {
-				assert.Equal(t, *aShapes[i].styleID, *eShapes[i].styleID, i)
-			}
-			assert.Equal(t, aShapes[i].pathIDs, eShapes[i].pathIDs, i)
+			styleID, pathIDs := shapeIndices(img, aShapes[i])
+			assert.Equal(t, tc.shapeStyles[i], styleID, i)
+			assert.Equal(t, tc.shapePathes[i], pathIDs, i)
 
 			assert.True(t, isNilOrObject(aShapes[i].Transforms, eShapes[i].Transforms), i)
 
@@ -272,3 +295,1581 @@ func TestRead(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.hvif")
+	if err != nil {
+		t.Fatalf("listing testdata: %e", err)
+	}
+
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("read file: %e", err)
+		}
+
+		img, err := ReadImage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("read image %s: %e", filename, err)
+		}
+
+		var buf bytes.Buffer
+		err = WriteImage(&buf, img)
+		assert.NoError(t, err, filename)
+
+		encoded := buf.Bytes()
+		assert.LessOrEqual(t, len(encoded), len(data), filename)
+
+		written, err := ReadImage(bytes.NewReader(encoded))
+		assert.NoError(t, err, filename)
+		assert.True(t, Equal(img, written, 0), filename)
+
+		marshaled, err := written.MarshalBinary()
+		assert.NoError(t, err, filename)
+		assert.Equal(t, encoded, marshaled, filename)
+	}
+}
+
+func TestShapeReferences(t *testing.T) {
+	red := &Color{Red: 0xff, Alpha: 0xff}
+	gray := &Color{Red: 0x80, Green: 0x80, Blue: 0x80, Alpha: 0xff}
+	square := &Path{isClosed: true, Elements: []PathElement{&Point{0, 0}, &Point{10, 0}, &Point{10, 10}, &Point{0, 10}}}
+	line := &Path{Elements: []PathElement{&Point{0, 0}, &Point{20, 20}}}
+
+	img := &Image{}
+	img.AddStyle(red)
+	img.AddStyle(gray)
+	img.AddPath(square)
+	img.AddPath(line)
+
+	sp := &Shape{}
+	sp.SetStyle(gray)
+	sp.SetPaths(line, square)
+	sp.AddPath(line)
+	img.AddShape(sp)
+
+	data, err := img.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{uint8(shapePathSource), 1, 3, 1, 0, 1, 0}, data[len(data)-7:])
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+	if assert.Len(t, decoded.GetShapes(), 1) {
+		dsp := decoded.GetShapes()[0]
+		assert.Same(t, decoded.GetStyles()[1], dsp.Style())
+		pathes := decoded.GetPathes()
+		assert.Equal(t, []*Path{pathes[1], pathes[0], pathes[1]}, dsp.Paths())
+	}
+
+	img.RemovePath(line)
+	assert.Equal(t, []*Path{square}, sp.Paths())
+	data, err = img.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{uint8(shapePathSource), 1, 1, 0, 0}, data[len(data)-5:])
+
+	// Style and pathes have to be in the image
+	sp.AddPath(line)
+	_, err = img.MarshalBinary()
+	assert.Error(t, err)
+	sp.RemovePath(line)
+
+	img.RemoveStyle(gray)
+	assert.Nil(t, sp.Style())
+	assert.Nil(t, img.GetShapeStyle(sp))
+	_, err = img.MarshalBinary()
+	assert.Error(t, err)
+
+	sp.SetStyle(gray)
+	assert.Nil(t, img.GetShapeStyle(sp))
+	_, err = img.MarshalBinary()
+	assert.Error(t, err)
+
+	sp.SetStyle(red)
+	_, err = img.MarshalBinary()
+	assert.NoError(t, err)
+}
+
+func TestShapeOrder(t *testing.T) {
+	img := &Image{}
+	shapes := make([]*Shape, 4)
+	for i := range shapes {
+		shapes[i] = &Shape{}
+		img.AddShape(shapes[i])
+	}
+	a, b, c, d := shapes[0], shapes[1], shapes[2], shapes[3]
+
+	img.MoveShape(a, 2)
+	assert.Equal(t, []*Shape{b, c, a, d}, img.GetShapes())
+	img.MoveShape(d, -5)
+	assert.Equal(t, []*Shape{d, b, c, a}, img.GetShapes())
+	img.RaiseShape(b)
+	assert.Equal(t, []*Shape{d, c, b, a}, img.GetShapes())
+	img.RaiseShape(a)
+	assert.Equal(t, []*Shape{d, c, b, a}, img.GetShapes())
+	img.LowerShape(c)
+	assert.Equal(t, []*Shape{c, d, b, a}, img.GetShapes())
+	img.LowerShape(c)
+	assert.Equal(t, []*Shape{c, d, b, a}, img.GetShapes())
+	img.ToFront(d)
+	assert.Equal(t, []*Shape{c, b, a, d}, img.GetShapes())
+	img.ToBack(a)
+	assert.Equal(t, []*Shape{a, c, b, d}, img.GetShapes())
+	img.ToBack(&Shape{})
+	assert.Equal(t, []*Shape{a, c, b, d}, img.GetShapes())
+
+	// Shapes keep their styles and pathes when those are reordered
+	data, err := os.ReadFile("testdata/ime.hvif")
+	if err != nil {
+		t.Fatalf("read file: %e", err)
+	}
+	original, err := Decode(data)
+	if err != nil {
+		t.Fatalf("decode: %e", err)
+	}
+	reordered := original.Clone()
+	reordered.MoveStyle(reordered.GetStyles()[0], 100)
+	reordered.MovePath(reordered.GetPathes()[3], 0)
+	assert.False(t, Equal(original, reordered, 0))
+
+	encoded, err := reordered.MarshalBinary()
+	assert.NoError(t, err)
+	decoded, err := Decode(encoded)
+	assert.NoError(t, err)
+	assert.True(t, Equal(reordered, decoded, 0))
+
+	decoded.MoveStyle(decoded.GetStyles()[len(decoded.GetStyles())-1], 0)
+	decoded.MovePath(decoded.GetPathes()[0], 3)
+	assert.True(t, Equal(original, decoded, 0))
+}
+
+func TestPrune(t *testing.T) {
+	data, err := os.ReadFile("testdata/ime.hvif")
+	if err != nil {
+		t.Fatalf("read file: %e", err)
+	}
+	img, err := Decode(data)
+	if err != nil {
+		t.Fatalf("decode: %e", err)
+	}
+	original := img.Clone()
+
+	styles, pathes := img.Prune()
+	assert.Empty(t, styles)
+	assert.Empty(t, pathes)
+	assert.True(t, Equal(original, img, 0))
+
+	unusedStyle := &Color{Red: 1, Alpha: 0xff}
+	unusedPath := &Path{Elements: []PathElement{&Point{1, 1}}}
+	img.AddStyle(unusedStyle)
+	img.MoveStyle(unusedStyle, 1)
+	img.AddPath(unusedPath)
+	img.MovePath(unusedPath, 0)
+	sp := img.GetShapes()[0]
+	removedStyle, removedPath := sp.Style(), sp.Paths()[0]
+	img.RemoveShape(sp)
+
+	styles, pathes = img.Prune()
+	assert.Equal(t, []Style{removedStyle, unusedStyle}, styles)
+	assert.Equal(t, []*Path{unusedPath, removedPath}, pathes)
+	assert.NotContains(t, img.GetStyles(), removedStyle)
+	assert.NotContains(t, img.GetPathes(), removedPath)
+	for _, p := range img.Validate() {
+		assert.True(t, p.Warning, p)
+	}
+
+	encoded, err := img.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Less(t, len(encoded), len(data))
+	decoded, err := Decode(encoded)
+	assert.NoError(t, err)
+	assert.True(t, Equal(img, decoded, 0))
+}
+
+func TestDedupe(t *testing.T) {
+	data, err := os.ReadFile("testdata/ime.hvif")
+	if err != nil {
+		t.Fatalf("read file: %e", err)
+	}
+	img, err := Decode(data)
+	if err != nil {
+		t.Fatalf("decode: %e", err)
+	}
+	original := img.Clone()
+	assert.Equal(t, DedupeReport{}, img.Dedupe(0))
+	assert.True(t, Equal(original, img, 0))
+
+	style := img.GetStyles()[2].Clone()
+	path := clonePath(img.GetPathes()[1])
+	path.Elements[0].(*Curve).Point.X += 0.005
+	sp := &Shape{}
+	sp.SetStyle(style)
+	sp.SetPaths(path, img.GetPathes()[0])
+	img.AddStyle(style)
+	img.MoveStyle(style, 0)
+	img.AddPath(path)
+	img.AddShape(sp)
+
+	before, err := img.MarshalBinary()
+	assert.NoError(t, err)
+
+	assert.Zero(t, img.Clone().Dedupe(0).Pathes)
+	report := img.Dedupe(0.01)
+	assert.Equal(t, 1, report.Styles)
+	assert.Equal(t, 1, report.Pathes)
+
+	after, err := img.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, len(before)-len(after), report.Saved)
+
+	// The duplicate style came first, so it is the one kept
+	assert.Same(t, style, img.GetStyles()[0])
+	assert.Same(t, style, sp.Style())
+	for _, p := range img.Validate() {
+		assert.True(t, p.Warning, p)
+	}
+	assert.Equal(t, []*Path{img.GetPathes()[1], img.GetPathes()[0]}, sp.Paths())
+	assert.Len(t, img.GetStyles(), len(original.GetStyles()))
+	assert.Len(t, img.GetPathes(), len(original.GetPathes()))
+}
+
+func TestImport(t *testing.T) {
+	data, err := os.ReadFile("testdata/ime.hvif")
+	if err != nil {
+		t.Fatalf("read file: %e", err)
+	}
+	base, err := Decode(data)
+	if err != nil {
+		t.Fatalf("decode: %e", err)
+	}
+	emblem, err := Decode(data)
+	if err != nil {
+		t.Fatalf("decode: %e", err)
+	}
+	unused := &Color{}
+	emblem.AddStyle(unused)
+
+	img := base.Clone()
+	assert.NoError(t, img.Import(emblem, ImportOptions{Scale: 0.5, X: 32, Y: 32}))
+	assert.Len(t, img.GetStyles(), 2*len(base.GetStyles()))
+	assert.Len(t, img.GetPathes(), 2*len(base.GetPathes()))
+	assert.Len(t, img.GetShapes(), 2*len(base.GetShapes()))
+	assert.NotContains(t, img.GetStyles(), unused)
+	for _, p := range img.Validate() {
+		assert.True(t, p.Warning, p)
+	}
+
+	for i, sp := range img.GetShapes()[len(base.GetShapes()):] {
+		orig := emblem.GetShapes()[i]
+		assert.NotSame(t, orig, sp)
+		assert.NotSame(t, orig.Paths()[0], sp.Paths()[0])
+		styleID, pathIDs := shapeIndices(emblem, orig)
+		iStyleID, iPathIDs := shapeIndices(img, sp)
+		assert.Equal(t, styleID+len(base.GetStyles()), iStyleID)
+		for j := range pathIDs {
+			assert.Equal(t, pathIDs[j]+len(base.GetPathes()), iPathIDs[j])
+		}
+
+		for _, p := range []Point{{0, 0}, {10, 0}, {3, 7}} {
+			expected := headerApply(orig, p)
+			actual := headerApply(sp, p)
+			asserPointsAreEqual(t, Point{expected.X/2 + 32, expected.Y/2 + 32}, actual, i)
+		}
+	}
+
+	encoded, err := img.MarshalBinary()
+	assert.NoError(t, err)
+	decoded, err := Decode(encoded)
+	assert.NoError(t, err)
+	// Composed matrices are rounded by the encoding
+	assert.True(t, Equal(img, decoded, 0.001))
+
+	// Translation only keeps the shape matrix out
+	badge := &Image{}
+	badge.AddStyle(&Color{Alpha: 0xff})
+	badge.AddPath(&Path{Elements: []PathElement{&Point{0, 0}, &Point{8, 8}}})
+	stroke := &TransformerStroke{Width: 2}
+	badge.AddShape(&Shape{style: badge.styles[0], paths: badge.pathes, Transforms: []Transformer{stroke}})
+	img = base.Clone()
+	assert.NoError(t, img.Import(badge, ImportOptions{X: 4}))
+	last := img.GetShapes()[len(img.GetShapes())-1]
+	assert.Equal(t, []Transformer{&TransformerTranslation{X: 4}, stroke}, last.Transforms)
+
+	for range 20 {
+		if err := img.Import(emblem, ImportOptions{}); err != nil {
+			assert.ErrorIs(t, err, ErrTooManyEntries)
+			break
+		}
+	}
+	assert.LessOrEqual(t, len(img.GetShapes()), 255)
+	assert.LessOrEqual(t, len(img.GetPathes()), 255)
+	assert.LessOrEqual(t, len(img.GetStyles()), 255)
+
+	// Shapes of unknown type stay last
+	unknown := &Image{}
+	unknown.AddShape(&Shape{Opaque: &OpaqueRecord{Type: 0x0b}})
+	img = base.Clone()
+	assert.NoError(t, img.Import(unknown, ImportOptions{}))
+	assert.NoError(t, img.Import(badge, ImportOptions{}))
+	shapes := img.GetShapes()
+	assert.NotNil(t, shapes[len(shapes)-1].Opaque)
+	assert.NoError(t, WriteImage(&bytes.Buffer{}, img))
+
+	assert.ErrorIs(t, img.Import(unknown, ImportOptions{}), ErrMisplacedOpaque)
+	unknown.shapes = append([]*Shape{unknown.shapes[0]}, badge.shapes...)
+	assert.ErrorIs(t, base.Clone().Import(unknown, ImportOptions{}), ErrMisplacedOpaque)
+	assert.Len(t, img.GetShapes(), len(shapes))
+}
+
+func TestValidate(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.hvif")
+	if err != nil {
+		t.Fatalf("listing testdata: %e", err)
+	}
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("read file: %e", err)
+		}
+		img, err := Decode(data)
+		if err != nil {
+			t.Fatalf("decode %s: %e", filename, err)
+		}
+		for _, p := range img.Validate() {
+			assert.True(t, p.Warning, "%s: %v", filename, p)
+		}
+	}
+
+	style := &Gradient{Colors: make([]Color, 3), Offsets: []uint8{0, 200, 100}}
+	path := &Path{Elements: []PathElement{&Point{0, 0}, &Curve{Point: Point{200, 0}}, &HLine{-130}}}
+	img := &Image{}
+	img.AddStyle(style)
+	img.AddStyle(&Gradient{Colors: make([]Color, 2)})
+	img.AddPath(path)
+	for range 256 {
+		img.AddShape(&Shape{})
+	}
+	img.shapes[0].SetStyle(style)
+	img.shapes[0].SetPaths(path, &Path{})
+	img.shapes[0].Transforms = []Transformer{&TransformerTranslation{X: 200}, &OpaqueRecord{}, &TransformerStroke{}}
+	img.shapes[1].SetStyle(&Color{})
+	img.shapes[1].Opaque = &OpaqueRecord{}
+
+	problems := img.Validate()
+	expected := []Problem{
+		{Section: SectionStyle, Index: 0, Element: 2, Warning: true, Err: ErrUnorderedOffsets},
+		{Section: SectionStyle, Index: 1, Element: -1, Err: ErrGradientStops},
+		{Section: SectionPath, Index: 0, Element: 1, Err: ErrCoordOutOfRange},
+		{Section: SectionPath, Index: 0, Element: 2, Err: ErrCoordOutOfRange},
+		{Section: SectionShape, Index: -1, Element: -1, Err: ErrTooManyEntries},
+		{Section: SectionShape, Index: 0, Element: -1, Err: ErrMisplacedOpaque},
+		{Section: SectionShape, Index: 0, Element: 1, Err: ErrDanglingReference},
+		{Section: SectionShape, Index: 0, Element: 0, Err: ErrCoordOutOfRange},
+		{Section: SectionShape, Index: 0, Element: 1, Err: ErrMisplacedOpaque},
+		{Section: SectionShape, Index: 1, Element: -1, Err: ErrMisplacedOpaque},
+		{Section: SectionShape, Index: 2, Element: -1, Err: ErrMissingStyle},
+		{Section: SectionShape, Index: 2, Element: -1, Warning: true, Err: ErrEmptyShape},
+	}
+	if assert.GreaterOrEqual(t, len(problems), len(expected)) {
+		for i, e := range expected {
+			assert.ErrorIs(t, problems[i], e.Err, i)
+			assert.Equal(t, e.Section, problems[i].Section, i)
+			assert.Equal(t, e.Index, problems[i].Index, i)
+			assert.Equal(t, e.Element, problems[i].Element, i)
+			assert.Equal(t, e.Warning, problems[i].Warning, i)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = WriteImage(&buf, img)
+	var invalid *InvalidImageError
+	if assert.ErrorAs(t, err, &invalid) {
+		for _, p := range invalid.Problems {
+			assert.False(t, p.Warning)
+		}
+	}
+	assert.ErrorIs(t, err, ErrDanglingReference)
+	assert.NotErrorIs(t, err, ErrEmptyShape)
+	assert.Zero(t, buf.Len())
+
+	// Values the encoder can not store
+	img = &Image{}
+	img.AddStyle(&Gradient{Transformable: &TransformerAffine{Matrix: Matrix{1e12, 0, 0, 1, 0, 0}}})
+	img.pathes = []*Path{nil, Rect(0, 0, 1, 1)}
+	sp := &Shape{Transforms: []Transformer{
+		&TransformerLodScale{MaxS: 5},
+		&TransformerAffine{Matrix: Matrix{1e12, 0, 0, 1, 0, 0}},
+		&TransformerStroke{Width: 300},
+		&TransformerContour{MiterLimit: -3},
+		&TransformerTranslation{},
+		&TransformerLodScale{},
+		&TransformerPerspective{Matrix: [9]float32{1e12, 0, 0, 0, 1, 0, 0, 0, 1}},
+		nil,
+	}}
+	folded := &Shape{Transforms: []Transformer{&TransformerAffine{Matrix: Scale(1e12, 1)}, &TransformerTranslation{X: 1}}}
+	for _, sp := range []*Shape{sp, folded} {
+		sp.SetStyle(img.styles[0])
+		sp.SetPaths(img.pathes[1])
+	}
+	img.shapes = []*Shape{sp, nil, folded}
+
+	problems = img.Validate()
+	expected = []Problem{
+		{Section: SectionStyle, Index: 0, Element: -1, Err: ErrFloat24Overflow},
+		{Section: SectionPath, Index: 0, Element: -1, Err: ErrUnsupportedElement},
+		{Section: SectionShape, Index: 0, Element: 0, Err: ErrValueOutOfRange},
+		{Section: SectionShape, Index: 0, Element: 1, Err: ErrFloat24Overflow},
+		{Section: SectionShape, Index: 0, Element: 2, Err: ErrValueOutOfRange},
+		{Section: SectionShape, Index: 0, Element: 3, Err: ErrValueOutOfRange},
+		{Section: SectionShape, Index: 0, Element: 4, Err: ErrUnsupportedElement},
+		{Section: SectionShape, Index: 0, Element: 5, Err: ErrUnsupportedElement},
+		{Section: SectionShape, Index: 0, Element: 6, Err: ErrFloat24Overflow},
+		{Section: SectionShape, Index: 0, Element: 7, Err: ErrUnsupportedElement},
+		{Section: SectionShape, Index: 1, Element: -1, Err: ErrUnsupportedElement},
+		{Section: SectionShape, Index: 2, Element: 0, Err: ErrFloat24Overflow},
+	}
+	if assert.Len(t, problems, len(expected)) {
+		for i, e := range expected {
+			assert.ErrorIs(t, problems[i], e.Err, i)
+			assert.Equal(t, e.Section, problems[i].Section, i)
+			assert.Equal(t, e.Index, problems[i].Index, i)
+			assert.Equal(t, e.Element, problems[i].Element, i)
+		}
+	}
+	assert.ErrorAs(t, WriteImage(&buf, img), &invalid)
+
+}
+
+func TestClone(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.hvif")
+	if err != nil {
+		t.Fatalf("listing testdata: %e", err)
+	}
+
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("read file: %e", err)
+		}
+		img, err := Decode(data)
+		if err != nil {
+			t.Fatalf("decode %s: %e", filename, err)
+		}
+		original, err := Decode(data)
+		if err != nil {
+			t.Fatalf("decode %s: %e", filename, err)
+		}
+
+		clone := img.Clone()
+		assert.True(t, Equal(img, clone, 0), filename)
+		for i, sp := range clone.shapes {
+			styleID, pathIDs := shapeIndices(img, img.shapes[i])
+			cStyleID, cPathIDs := shapeIndices(clone, sp)
+			assert.Equal(t, styleID, cStyleID, filename)
+			assert.Equal(t, pathIDs, cPathIDs, filename)
+		}
+
+		// Modifying the copy leaves the original intact
+		for _, s := range clone.styles {
+			switch s := s.(type) {
+			case *Color:
+				s.Red++
+			case *Gradient:
+				s.Colors[0].Red++
+				s.Offsets[0]++
+				if s.Transformable != nil {
+					s.Transformable.Matrix[0]++
+				}
+			}
+		}
+		for _, p := range clone.pathes {
+			p.isClosed = !p.isClosed
+			for _, e := range p.Elements {
+				switch e := e.(type) {
+				case *Point:
+					e.X++
+				case *HLine:
+					e.X++
+				case *VLine:
+					e.Y++
+				case *Curve:
+					e.Point.X++
+				}
+			}
+		}
+		for _, sp := range clone.shapes {
+			sp.Hinting = !sp.Hinting
+			sp.SetStyle(nil)
+			for _, tr := range sp.Transforms {
+				switch tr := tr.(type) {
+				case *TransformerAffine:
+					tr.Matrix[0]++
+				case *TransformerStroke:
+					tr.Width++
+				case *TransformerTranslation:
+					tr.X++
+				}
+			}
+		}
+		assert.True(t, Equal(img, original, 0), filename)
+		assert.False(t, Equal(img, clone, 0), filename)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	style := &Color{Red: 1, Alpha: 0xff}
+	path := &Path{Elements: []PathElement{&Point{0, 0}, &Point{10, 0}}}
+	img := &Image{}
+	img.AddStyle(style)
+	img.AddPath(path)
+	img.AddShape(&Shape{style: style, paths: []*Path{path}, Transforms: []Transformer{&TransformerTranslation{X: 1}}})
+
+	other := img.Clone()
+	other.pathes[0].Elements = []PathElement{&Point{0, 0}, &HLine{10.01}}
+	other.shapes[0].Transforms[0].(*TransformerTranslation).X = 0.99
+	assert.True(t, Equal(img, other, 0.02))
+	assert.False(t, Equal(img, other, 0.001))
+
+	// Shapes are compared by the positions of their styles and pathes
+	other = img.Clone()
+	other.AddStyle(&Color{Red: 1, Alpha: 0xff})
+	assert.False(t, Equal(img, other, 0))
+	other.styles = other.styles[1:]
+	other.shapes[0].SetStyle(other.styles[0])
+	assert.True(t, Equal(img, other, 0))
+	other.styles[0] = &Color{Red: 1, Alpha: 0xff}
+	assert.False(t, Equal(img, other, 0))
+
+	assert.True(t, Equal(nil, nil, 0))
+	assert.False(t, Equal(img, nil, 0))
+}
+
+func TestWritePathLayout(t *testing.T) {
+	testdata := []struct {
+		name     string
+		path     Path
+		flag     pathFlag
+		size     int
+		elements []PathElement
+	}{
+		{
+			"degenerate curves",
+			Path{isClosed: true, Elements: []PathElement{
+				&Curve{PointIn: Point{0, 0}, Point: Point{0, 0}, PointOut: Point{0, 0}},
+				&Curve{PointIn: Point{10, 10}, Point: Point{10, 10}, PointOut: Point{10, 10}},
+			}},
+			pathFlagClosed | pathFlagNoCurves,
+			2 + 4,
+			[]PathElement{&Point{0, 0}, &Point{10, 10}},
+		},
+		{
+			"axis aligned lines",
+			Path{Elements: []PathElement{
+				&Point{10, 10}, &Point{50, 10}, &Point{50, 50},
+				&Curve{PointIn: Point{20, 40}, Point: Point{10, 50}, PointOut: Point{0, 60}},
+			}},
+			pathFlagUsesCommands,
+			2 + 1 + 2 + 1 + 1 + 6,
+			[]PathElement{&Point{10, 10}, &HLine{50}, &VLine{50}, &Curve{PointIn: Point{20, 40}, Point: Point{10, 50}, PointOut: Point{0, 60}}},
+		},
+		{
+			"curves",
+			Path{Elements: []PathElement{
+				&Curve{PointIn: Point{1, 2}, Point: Point{3, 4}, PointOut: Point{5, 6}},
+			}},
+			0,
+			2 + 6,
+			[]PathElement{&Curve{PointIn: Point{1, 2}, Point: Point{3, 4}, PointOut: Point{5, 6}}},
+		},
+	}
+
+	for _, tc := range testdata {
+		var buf bytes.Buffer
+		err := writePath(&buf, &tc.path)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, uint8(tc.flag), buf.Bytes()[0], tc.name)
+		assert.Equal(t, tc.size, buf.Len(), tc.name)
+
+		p, err := readPath(newByteReader(buf.Bytes()), true)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.elements, p.Elements, tc.name)
+	}
+}
+
+func TestTransformerApply(t *testing.T) {
+	p := Point{2, 3}
+	testdata := []struct {
+		transformer Transformer
+		kind        TransformerKind
+		expected    Point
+	}{
+		{&TransformerTranslation{X: 1, Y: -1}, TransformerKindTranslation, Point{3, 2}},
+		{&TransformerLodScale{MinS: 1, MaxS: 2}, TransformerKindLodScale, p},
+		{&TransformerAffine{Matrix: [6]float32{2, 0, 1, 3, 10, 20}}, TransformerKindAffine, Point{17, 29}},
+		{&TransformerPerspective{Matrix: [9]float32{1, 0, 0, 0, 1, 0, 0, 0, 2}}, TransformerKindPerspective, Point{1, 1.5}},
+		{&TransformerContour{Width: 2}, TransformerKindContour, p},
+		{&TransformerStroke{Width: 2}, TransformerKindStroke, p},
+		{&OpaqueRecord{Type: 30, Data: []byte{1}}, TransformerKindOpaque, p},
+	}
+
+	for _, tc := range testdata {
+		assert.Equal(t, tc.kind, tc.transformer.Kind())
+		assert.Equal(t, tc.expected, tc.transformer.Apply(p), tc.kind)
+
+		c := tc.transformer.Clone()
+		assert.Equal(t, tc.transformer, c, tc.kind)
+		assert.NotSame(t, tc.transformer, c, tc.kind)
+	}
+
+	for _, e := range []PathElement{&Point{1, 2}, &HLine{1}, &VLine{2}, &Curve{Point: Point{1, 2}}} {
+		c := e.Clone()
+		assert.Equal(t, e, c)
+		assert.NotSame(t, e, c)
+		assert.Equal(t, e.Kind(), c.Kind())
+	}
+
+	g := &Gradient{Colors: []Color{{Red: 1}}, Offsets: []uint8{0}, Transformable: &TransformerAffine{}}
+	c := g.Clone().(*Gradient)
+	assert.Equal(t, g, c)
+	c.Colors[0].Red = 2
+	c.Transformable.Matrix[0] = 1
+	assert.Equal(t, uint8(1), g.Colors[0].Red)
+	assert.Zero(t, g.Transformable.Matrix[0])
+	assert.Equal(t, StyleKindGradient, c.Kind())
+}
+
+func TestPathBuilder(t *testing.T) {
+	p, err := NewPathBuilder().
+		MoveTo(Point{10, 10}).
+		HLineTo(20).
+		VLineTo(30).
+		CurveTo(Point{30, 30}, Point{40, 20}, Point{40, 10}).
+		SmoothCurveTo(Point{50, 0}, Point{60, 10}).
+		LineTo(Point{60, 60}).
+		Close().
+		Path()
+	assert.NoError(t, err)
+	assert.True(t, p.isClosed)
+	assert.Equal(t, []PathElement{
+		&Point{10, 10},
+		&HLine{20},
+		&Curve{PointIn: Point{20, 30}, Point: Point{20, 30}, PointOut: Point{30, 30}},
+		&Curve{PointIn: Point{40, 20}, Point: Point{40, 10}, PointOut: Point{40, 0}},
+		&Curve{PointIn: Point{50, 0}, Point: Point{60, 10}, PointOut: Point{60, 10}},
+		&Point{60, 60},
+	}, p.Elements)
+
+	_, err = NewPathBuilder().MoveTo(Point{0, 0}).MoveTo(Point{1, 1}).Path()
+	assert.Error(t, err)
+	for name, b := range map[string]*PathBuilder{
+		"line":         NewPathBuilder().LineTo(Point{1, 1}),
+		"hline":        NewPathBuilder().HLineTo(1),
+		"vline":        NewPathBuilder().VLineTo(1),
+		"curve":        NewPathBuilder().CurveTo(Point{1, 0}, Point{0, 1}, Point{1, 1}),
+		"smooth curve": NewPathBuilder().SmoothCurveTo(Point{0, 1}, Point{1, 1}),
+	} {
+		_, err = b.MoveTo(Point{0, 0}).Path()
+		assert.Error(t, err, name)
+	}
+
+	rect, err := resolvePathElements(Rect(1, 2, 10, 20).Elements)
+	assert.NoError(t, err)
+	assert.Equal(t, []pathNode{
+		lineNode(Point{1, 2}), lineNode(Point{11, 2}), lineNode(Point{11, 22}), lineNode(Point{1, 22}),
+	}, rect)
+	assert.Equal(t, Rect(0, 0, 4, 4), RoundedRect(0, 0, 4, 4, 0))
+
+	for _, e := range Ellipse(32, 32, 10, 20).Elements {
+		c := e.(*Curve)
+		dx, dy := (c.Point.X-32)/10, (c.Point.Y-32)/20
+		assert.InDelta(t, 1, dx*dx+dy*dy, 0.0001)
+	}
+
+	star := Star(32, 32, 20, 10, 5)
+	assert.True(t, star.isClosed)
+	if assert.Len(t, star.Elements, 10) {
+		asserPointsAreEqual(t, Point{32, 12}, *star.Elements[0].(*Point), 0)
+	}
+
+	img := &Image{}
+	img.AddStyle(&Color{Alpha: 0xff})
+	for _, p := range []*Path{p, RoundedRect(4, 4, 56, 40, 6), Ellipse(32, 32, 10, 20), star, Polygon(Point{0, 0}, Point{5, 0}, Point{0, 5})} {
+		img.AddPath(p)
+	}
+	img.AddShape(&Shape{style: img.styles[0], paths: img.pathes})
+	encoded, err := img.MarshalBinary()
+	assert.NoError(t, err)
+	decoded, err := Decode(encoded)
+	assert.NoError(t, err)
+	assert.True(t, Equal(img, decoded, 0.01))
+}
+
+func TestPathCurves(t *testing.T) {
+	p := &Path{Elements: []PathElement{
+		&Point{10, 10}, &HLine{20}, &VLine{30},
+		&Curve{PointIn: Point{25, 35}, Point: Point{20, 40}, PointOut: Point{15, 45}},
+		&HLine{0},
+	}}
+	expected := []Curve{
+		{PointIn: Point{10, 10}, Point: Point{10, 10}, PointOut: Point{10, 10}},
+		{PointIn: Point{20, 10}, Point: Point{20, 10}, PointOut: Point{20, 10}},
+		{PointIn: Point{20, 30}, Point: Point{20, 30}, PointOut: Point{20, 30}},
+		{PointIn: Point{25, 35}, Point: Point{20, 40}, PointOut: Point{15, 45}},
+		{PointIn: Point{0, 40}, Point: Point{0, 40}, PointOut: Point{0, 40}},
+	}
+	assert.Equal(t, expected, p.Curves())
+
+	original := clonePath(p)
+	p.Normalize()
+	for i, e := range p.Elements {
+		assert.Equal(t, &expected[i], e)
+	}
+	assert.True(t, Equal(&Image{pathes: []*Path{original}}, &Image{pathes: []*Path{p}}, 0))
+
+	assert.False(t, p.Closed())
+	p.SetClosed(true)
+	assert.True(t, p.Closed())
+
+	broken := &Path{Elements: []PathElement{&Point{}, nil}}
+	assert.Nil(t, broken.Curves())
+	broken.Normalize()
+	assert.Len(t, broken.Elements, 2)
+	assert.Empty(t, (&Path{}).Curves())
+}
+
+func assertMatricesAreEqual(t *testing.T, e, a Matrix, msg any) {
+	assert.InDeltaSlice(t, e[:], a[:], 0.0001, msg)
+}
+
+func TestWriteShapeHeader(t *testing.T) {
+	img := &Image{}
+	color := &Color{Red: 0xff, Alpha: 0xff}
+	img.AddStyle(color)
+	img.AddPath(Rect(0, 0, 10, 10))
+
+	for name, tc := range map[string]struct {
+		transforms []Transformer
+		flags      shapeFlag
+		header     Transformer
+	}{
+		"affine and translation": {
+			transforms: []Transformer{&TransformerAffine{Matrix: Scale(2, 2)}, &TransformerTranslation{X: 10, Y: 20}},
+			flags:      shapeFlagTransform,
+			header:     &TransformerAffine{Matrix: Matrix{2, 0, 0, 2, 10, 20}},
+		},
+		"translating affine and translation": {
+			transforms: []Transformer{&TransformerAffine{Matrix: Translate(1, 2)}, &TransformerTranslation{X: 10, Y: 20}},
+			flags:      shapeFlagTranslation,
+			header:     &TransformerTranslation{X: 11, Y: 22},
+		},
+		"translation": {
+			transforms: []Transformer{&TransformerTranslation{X: 10, Y: 20}, &TransformerLodScale{MinS: 1, MaxS: 4}},
+			flags:      shapeFlagTranslation | shapeFlagLodScale,
+			header:     &TransformerTranslation{X: 10, Y: 20},
+		},
+	} {
+		sp := &Shape{Transforms: tc.transforms}
+		sp.SetStyle(color)
+		sp.SetPaths(img.pathes...)
+
+		var buf bytes.Buffer
+		assert.NoError(t, writeShape(&buf, sp, newShapeIndex(img)), name)
+		assert.Equal(t, tc.flags, shapeFlag(buf.Bytes()[4]), name)
+
+		read, _, err := readShape(newByteReader(buf.Bytes()), true)
+		assert.NoError(t, err, name)
+		assert.True(t, (&comparer{tolerance: 0.001}).transformer(tc.header, read.Transforms[0]), name)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	p := Point{3, 4}
+	asserPointsAreEqual(t, p, Identity().Apply(p), "identity")
+	asserPointsAreEqual(t, Point{4, 2}, Translate(1, -2).Apply(p), "translate")
+	asserPointsAreEqual(t, Point{6, 2}, Scale(2, 0.5).Apply(p), "scale")
+	asserPointsAreEqual(t, Point{-4, 3}, Rotate(math.Pi/2).Apply(p), "rotate")
+	asserPointsAreEqual(t, Point{7, 4}, Skew(math.Pi/4, 0).Apply(p), "skew")
+
+	m := Scale(2, 3).Multiply(Rotate(0.3)).Multiply(Translate(5, 7))
+	asserPointsAreEqual(t, Translate(5, 7).Apply(Rotate(0.3).Apply(Scale(2, 3).Apply(p))), m.Apply(p), "multiply")
+
+	inv, ok := m.Invert()
+	assert.True(t, ok)
+	assertMatricesAreEqual(t, Identity(), m.Multiply(inv), "invert")
+	_, ok = Scale(0, 1).Invert()
+	assert.False(t, ok)
+
+	for _, d := range []Decomposition{
+		{ScaleX: 2, ScaleY: 3, Skew: 0.2, Rotation: 0.7, TranslateX: 5, TranslateY: -1},
+		{ScaleX: 1, ScaleY: -1, Rotation: -2},
+	} {
+		decomposed := d.Matrix().Decompose()
+		assert.InDelta(t, d.ScaleX, decomposed.ScaleX, 0.0001)
+		assert.InDelta(t, d.ScaleY, decomposed.ScaleY, 0.0001)
+		assert.InDelta(t, d.Skew, decomposed.Skew, 0.0001)
+		assert.InDelta(t, d.Rotation, decomposed.Rotation, 0.0001)
+		assertMatricesAreEqual(t, d.Matrix(), decomposed.Matrix(), d)
+	}
+
+	// Transformers of the list come first, then the shape matrix
+	sp := &Shape{Transforms: []Transformer{
+		&TransformerAffine{Matrix: Rotate(math.Pi / 2)},
+		&TransformerTranslation{X: 10, Y: 20},
+		&TransformerStroke{Width: 2},
+		&TransformerAffine{Matrix: Scale(2, 2)},
+	}}
+	effective, ok := sp.EffectiveMatrix()
+	assert.True(t, ok)
+	asserPointsAreEqual(t, Point{10, 22}, effective.Apply(Point{1, 0}), "effective")
+
+	sp.Transforms = append(sp.Transforms, &TransformerPerspective{})
+	_, ok = sp.EffectiveMatrix()
+	assert.False(t, ok)
+}
+
+func assertBoxesAreEqual(t *testing.T, e, a Box, msg any) {
+	asserPointsAreEqual(t, e.Min, a.Min, msg)
+	asserPointsAreEqual(t, e.Max, a.Max, msg)
+}
+
+func TestBounds(t *testing.T) {
+	arch := &Path{Elements: []PathElement{
+		&Curve{PointIn: Point{0, 0}, Point: Point{0, 0}, PointOut: Point{0, 30}},
+		&Curve{PointIn: Point{10, 30}, Point: Point{10, 0}, PointOut: Point{10, 0}},
+	}}
+	assertBoxesAreEqual(t, Box{Min: Point{0, 0}, Max: Point{10, 22.5}}, arch.Bounds(), "arch")
+	arch.SetClosed(true)
+	assertBoxesAreEqual(t, Box{Min: Point{0, 0}, Max: Point{10, 22.5}}, arch.Bounds(), "closed arch")
+
+	assertBoxesAreEqual(t, Box{Min: Point{22, 12}, Max: Point{42, 52}}, Ellipse(32, 32, 10, 20).Bounds(), "ellipse")
+	assertBoxesAreEqual(t, Box{Min: Point{1, 2}, Max: Point{11, 22}}, Rect(1, 2, 10, 20).Bounds(), "rect")
+	assert.True(t, (&Path{}).Bounds().Empty())
+
+	sp := &Shape{paths: []*Path{Rect(0, 0, 10, 10), arch}}
+	assertBoxesAreEqual(t, Box{Min: Point{0, 0}, Max: Point{10, 22.5}}, sp.Bounds(), "shape")
+
+	sp.Transforms = []Transformer{&TransformerAffine{Matrix: Rotate(math.Pi / 2)}, &TransformerTranslation{X: 40}}
+	assertBoxesAreEqual(t, Box{Min: Point{17.5, 0}, Max: Point{40, 10}}, sp.Bounds(), "transformed shape")
+
+	sp.Transforms = append(sp.Transforms, &TransformerStroke{Width: 4, LineJoin: RoundJoin}, &TransformerAffine{Matrix: Scale(2, 2)})
+	assertBoxesAreEqual(t, Box{Min: Point{-9, -4}, Max: Point{44, 24}}, sp.Bounds(), "stroked shape")
+
+	img := &Image{}
+	img.AddPath(Rect(50, 50, 4, 4))
+	img.AddShape(sp)
+	img.AddShape(&Shape{paths: img.pathes})
+	img.AddShape(&Shape{Opaque: &OpaqueRecord{}})
+	bounds := img.Bounds()
+	assertBoxesAreEqual(t, Box{Min: Point{-9, -4}, Max: Point{54, 54}}, bounds, "image")
+	asserPointsAreEqual(t, Point{22.5, 25}, bounds.Center(), "center")
+	assert.InDelta(t, 63, bounds.Width(), 0.0001)
+	assert.True(t, (&Image{}).Bounds().Empty())
+	assert.Zero(t, (&Image{}).Bounds().Width())
+}
+
+func TestHitTest(t *testing.T) {
+	img := &Image{}
+	color := &Color{Red: 0xff, Alpha: 0xff}
+	img.AddStyle(color)
+	square, circle := Rect(0, 0, 20, 20), Ellipse(10, 10, 10, 10)
+	hole := Rect(15, 15, 10, 10)
+	reversed := Polygon(Point{15, 15}, Point{15, 25}, Point{25, 25}, Point{25, 15})
+	line := &Path{Elements: []PathElement{&Point{40, 0}, &Point{40, 20}}}
+	for _, p := range []*Path{square, circle, hole, reversed, line} {
+		img.AddPath(p)
+	}
+
+	bottom := &Shape{}
+	bottom.SetStyle(color)
+	bottom.SetPaths(square)
+	img.AddShape(bottom)
+
+	top := &Shape{Transforms: []Transformer{&TransformerTranslation{X: 10, Y: 10}}}
+	top.SetStyle(color)
+	top.SetPaths(circle, reversed)
+	img.AddShape(top)
+
+	stroked := &Shape{Transforms: []Transformer{&TransformerStroke{Width: 2}, &TransformerAffine{Matrix: Scale(2, 2)}}}
+	stroked.SetStyle(color)
+	stroked.SetPaths(line)
+	img.AddShape(stroked)
+
+	detail := &Shape{Transforms: []Transformer{&TransformerLodScale{MinS: 2, MaxS: 4}}}
+	detail.SetStyle(color)
+	detail.SetPaths(square)
+	img.AddShape(detail)
+
+	img.AddShape(&Shape{Opaque: &OpaqueRecord{}})
+
+	assert.Equal(t, []*Shape{top, bottom}, img.ShapesAt(15, 15))
+	assert.Same(t, top, img.ShapeAt(15, 15))
+	assert.Same(t, bottom, img.ShapeAt(2, 2))
+	assert.Same(t, detail, img.ShapeAtScale(2, 2, 2))
+	assert.Equal(t, []*Shape{detail, bottom}, img.ShapesAtScale(2, 2, 4))
+
+	// The reversed square makes a hole where it overlaps the circle
+	assert.Nil(t, img.ShapeAt(26, 26))
+	assert.Same(t, top, img.ShapeAt(29, 29))
+	assert.Same(t, top, img.ShapeAt(19, 28))
+	top.SetPaths(circle, hole)
+	assert.Same(t, top, img.ShapeAt(26, 26))
+
+	// The line is stroked 2 units wide, then scaled twice
+	assert.Same(t, stroked, img.ShapeAt(81, 20))
+	assert.Same(t, stroked, img.ShapeAt(78.5, 40))
+	assert.Nil(t, img.ShapeAt(83, 20))
+	assert.Nil(t, img.ShapeAt(80, 44))
+
+	stroked.Transforms = []Transformer{&TransformerContour{Width: 1}, &TransformerTranslation{X: 5}}
+	stroked.SetPaths(square)
+	assert.Same(t, stroked, img.ShapeAt(25.5, 10))
+	assert.Nil(t, img.ShapeAt(26.5, 10))
+
+	assert.Nil(t, img.ShapeAt(100, 100))
+	assert.Empty(t, (&Image{}).ShapesAt(0, 0))
+}
+
+func TestLodScale(t *testing.T) {
+	img := &Image{}
+	red, blue := &Color{Red: 0xff, Alpha: 0xff}, &Color{Blue: 0xff, Alpha: 0xff}
+	img.AddStyle(red)
+	img.AddStyle(blue)
+	square, detail := Rect(0, 0, 20, 20), Rect(5, 5, 2, 2)
+	img.AddPath(square)
+	img.AddPath(detail)
+
+	always := &Shape{}
+	always.SetStyle(red)
+	always.SetPaths(square)
+	img.AddShape(always)
+
+	large := &Shape{Transforms: []Transformer{&TransformerTranslation{X: 1}, &TransformerStroke{Width: 1}}}
+	large.SetStyle(blue)
+	large.SetPaths(detail)
+	large.SetLodScale(1, 4)
+	img.AddShape(large)
+	img.AddShape(&Shape{Opaque: &OpaqueRecord{}})
+
+	assert.IsType(t, &TransformerLodScale{}, large.Transforms[1])
+	minS, maxS, ok := large.LodScale()
+	assert.True(t, ok)
+	assert.Equal(t, []float32{1, 4}, []float32{minS, maxS})
+	_, _, ok = always.LodScale()
+	assert.False(t, ok)
+
+	assert.Equal(t, []*Shape{always, large}, img.VisibleShapes(1))
+	assert.Equal(t, []*Shape{always, large}, img.VisibleShapes(8))
+	assert.Equal(t, []*Shape{always}, img.VisibleShapes(0.25))
+
+	large.SetLodScale(1, 2)
+	assert.Len(t, large.Transforms, 3)
+	assert.Equal(t, []*Shape{always}, img.VisibleShapes(3))
+
+	small := img.AtScale(0.25)
+	assert.Len(t, small.shapes, 1)
+	assert.Equal(t, []Style{small.shapes[0].Style()}, small.styles)
+	assert.Len(t, small.pathes, 1)
+	assert.Len(t, img.shapes, 3)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteImage(&buf, img))
+	written, err := Decode(buf.Bytes())
+	assert.NoError(t, err)
+	minS, maxS, ok = written.shapes[1].LodScale()
+	assert.True(t, ok)
+	assert.InDelta(t, 1, minS, 0.01)
+	assert.InDelta(t, 2, maxS, 0.01)
+
+	large.SetLodScale(-1, 8)
+	buf.Reset()
+	assert.NoError(t, WriteImage(&buf, img))
+	written, err = Decode(buf.Bytes())
+	assert.NoError(t, err)
+	minS, maxS, _ = written.shapes[1].LodScale()
+	assert.Equal(t, []float32{0, 4}, []float32{minS, maxS})
+	assert.True(t, written.shapes[1].VisibleAt(8))
+
+	// A misplaced level of detail is replaced
+	large.Transforms = append(large.Transforms, &TransformerLodScale{MinS: 3, MaxS: 4})
+	large.SetLodScale(0, 1)
+	assert.Len(t, large.Transforms, 3)
+	assert.Equal(t, &TransformerLodScale{MinS: 0, MaxS: 1}, large.Transforms[1])
+
+	large.ClearLodScale()
+	assert.Len(t, large.Transforms, 2)
+	assert.Len(t, img.VisibleShapes(0.25), 2)
+	assert.Len(t, img.AtScale(0.25).shapes, 2)
+}
+
+func TestQuantize(t *testing.T) {
+	for _, v := range []float32{-128, -32, 0, 0.5, 1.0 / 3, 12.345, 95, 95.5, 150.77, MaxCoord} {
+		q, ok := QuantizeCoord(v)
+		assert.True(t, ok, v)
+		assert.InDelta(t, v, q, 0.5/102, v)
+
+		data, err := AppendCoord(nil, q)
+		assert.NoError(t, err, v)
+		decoded, err := readFloatCoord(newByteReader(data))
+		assert.NoError(t, err, v)
+		assert.Equal(t, q, decoded, v)
+	}
+	for _, v := range []float32{-129, 200, float32(math.NaN())} {
+		_, err := AppendCoord(nil, v)
+		assert.ErrorIs(t, err, ErrCoordOutOfRange, v)
+	}
+
+	img := &Image{
+		pathes: []*Path{{Elements: []PathElement{
+			&Point{1.3, 2}, &HLine{500}, &Curve{PointIn: Point{0.25, 0}, Point: Point{-300, 0}, PointOut: Point{0, 0}},
+		}}},
+		shapes: []*Shape{
+			{Transforms: []Transformer{&TransformerTranslation{X: 10.001, Y: 0}}},
+			{Transforms: []Transformer{&TransformerAffine{Matrix: Scale(2, 2)}, &TransformerTranslation{X: 10.001}}},
+			{Transforms: []Transformer{&TransformerAffine{Matrix: Scale(1e12, 1)}, &TransformerTranslation{X: 1}}},
+		},
+	}
+
+	report := img.Quantize()
+	assert.InDelta(t, 0.5/102, report.MaxError, 0.0001)
+	assert.Equal(t, []CoordLocation{
+		{Path: 0, Shape: -1, Element: 1, Value: 500},
+		{Path: 0, Shape: -1, Element: 2, Value: -300},
+		{Path: -1, Shape: 2, Element: 0, Value: 1e12},
+	}, report.OutOfRange)
+	assert.InDelta(t, MaxCoord, img.pathes[0].Elements[1].(*HLine).X, 0.0001)
+	assert.Equal(t, float32(10), img.shapes[0].Transforms[0].(*TransformerTranslation).X)
+
+	// Folded with the affine transformation, the translation is written as float24
+	tx, err := QuantizeFloat24(10.001)
+	assert.NoError(t, err)
+	assert.NotEqual(t, float32(10), tx)
+	assert.Equal(t, []Transformer{&TransformerAffine{Matrix: Matrix{2, 0, 0, 2, tx, 0}}}, img.shapes[1].Transforms)
+
+	second := img.Quantize()
+	assert.Zero(t, second.MaxError)
+	assert.Empty(t, second.OutOfRange)
+}
+
+func TestFloat24(t *testing.T) {
+	testdata := []struct {
+		value    float32
+		expected float32
+		exact    bool
+		err      error
+	}{
+		{0, 0, true, nil},
+		{1, 1, true, nil},
+		{-0.03125, -0.03125, true, nil},
+		{37.884033, 37.884033, true, nil},
+		{0.1, 0.099999905, false, nil},
+		{1 + 1.0/(1<<17) + 1.0/(1<<18), 1 + 2.0/(1<<17), false, nil},
+		{0x1.ffffffp31, 0, false, ErrFloat24Overflow},
+		{0x1p32, 0, false, ErrFloat24Overflow},
+		{0x1p-31, 0x1p-31, true, nil},
+		{0x1p-40, 0, false, nil},
+		{math.SmallestNonzeroFloat32, 0, false, nil},
+		{float32(math.Inf(1)), 0, false, ErrFloat24Overflow},
+	}
+
+	for _, tc := range testdata {
+		q, err := QuantizeFloat24(tc.value)
+		assert.ErrorIs(t, err, tc.err, tc.value)
+		assert.Equal(t, tc.expected, q, tc.value)
+		assert.Equal(t, tc.exact, IsFloat24Exact(tc.value), tc.value)
+
+		if tc.err != nil {
+			continue
+		}
+		data, err := AppendFloat24(nil, tc.value)
+		assert.NoError(t, err, tc.value)
+		decoded, err := readFloat24(newByteReader(data))
+		assert.NoError(t, err, tc.value)
+		assert.Equal(t, q, decoded, tc.value)
+	}
+
+	affine := TransformerAffine{Matrix: [6]float32{0.5, 0, 0, 0.25, 32, 16}}
+	assert.True(t, affine.IsExact())
+	affine.Matrix[0] = 0.1
+	assert.False(t, affine.IsExact())
+	perspective := TransformerPerspective{Matrix: [9]float32{1, 0, 0, 0, 1, 0, 0, 0, 1}}
+	assert.True(t, perspective.IsExact())
+}
+
+func TestWriteStyleCompactColors(t *testing.T) {
+	testdata := []struct {
+		style Style
+		size  int
+	}{
+		{&Color{Red: 10, Green: 20, Blue: 30, Alpha: 40}, 1 + 4},
+		{&Color{Red: 10, Green: 20, Blue: 30, Alpha: 255}, 1 + 3},
+		{&Color{Red: 10, Green: 10, Blue: 10, Alpha: 40}, 1 + 2},
+		{&Color{Red: 10, Green: 10, Blue: 10, Alpha: 255}, 1 + 1},
+		{&Gradient{Type: GradientConic, Offsets: []uint8{0, 255}, Colors: []Color{
+			{Red: 1, Green: 1, Blue: 1, Alpha: 255},
+			{Red: 2, Green: 2, Blue: 2, Alpha: 255},
+		}}, 1 + 3 + 2*(1+1)},
+		{&Gradient{Type: GradientConic, Offsets: []uint8{0, 255}, Colors: []Color{
+			{Red: 1, Green: 1, Blue: 1, Alpha: 255},
+			{Red: 2, Green: 2, Blue: 2, Alpha: 0},
+		}}, 1 + 3 + 2*(1+2)},
+		{&Gradient{Type: GradientConic, Offsets: []uint8{0, 255}, Colors: []Color{
+			{Red: 1, Green: 1, Blue: 1, Alpha: 255},
+			{Red: 2, Green: 3, Blue: 2, Alpha: 255},
+		}}, 1 + 3 + 2*(1+3)},
+		{&Gradient{Type: GradientConic, Offsets: []uint8{0, 255}, Colors: []Color{
+			{Red: 1, Green: 1, Blue: 1, Alpha: 255},
+			{Red: 2, Green: 3, Blue: 2, Alpha: 0},
+		}}, 1 + 3 + 2*(1+4)},
+	}
+
+	for i, tc := range testdata {
+		var buf bytes.Buffer
+		err := writeStyle(&buf, tc.style)
+		assert.NoError(t, err, i)
+		assert.Equal(t, tc.size, buf.Len(), i)
+
+		s, err := readStyle(newByteReader(buf.Bytes()), true)
+		assert.NoError(t, err, i)
+		assert.Equal(t, tc.style, s, i)
+	}
+}
+
+func TestReadDecodeError(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.hvif")
+	if err != nil {
+		t.Fatalf("read file: %e", err)
+	}
+	shapeOffset := len(data) - 5
+
+	modified := func(offset int, b ...byte) []byte {
+		res := slices.Clone(data[:offset])
+		return append(res, b...)
+	}
+
+	testdata := []struct {
+		name    string
+		data    []byte
+		cause   error
+		offset  int64
+		section Section
+		index   int
+		shape   int
+	}{
+		{"bad magic", append([]byte("ncfi"), data[4:]...), ErrBadMagic, 0, SectionHeader, -1, -1},
+		{"unknown style", modified(9, 0x7f), ErrUnknownStyleType, 9, SectionStyle, 1, -1},
+		{
+			"unknown shape", append(modified(shapeOffset-1, 2, 0x0b), data[shapeOffset:]...),
+			ErrUnknownShapeType, int64(shapeOffset), SectionShape, 0, -1,
+		},
+		{
+			"unknown transformer", modified(len(data)-1, uint8(shapeFlagHasTransformers), 2, 0x63),
+			ErrUnknownTransformer, int64(len(data) + 1), SectionTransformer, 0, 0,
+		},
+		{"truncated count", data[:13], ErrTruncated, 13, SectionPath, -1, -1},
+		{"truncated path", data[:20], ErrTruncated, 20, SectionPath, 0, -1},
+	}
+
+	decoders := map[string]func([]byte) (*Image, error){
+		"bytes reader": func(data []byte) (*Image, error) { return ReadImage(bytes.NewReader(data)) },
+		"plain reader": func(data []byte) (*Image, error) { return ReadImage(iotest.OneByteReader(bytes.NewReader(data))) },
+		"decode":       Decode,
+	}
+
+	for name, decode := range decoders {
+		for _, tc := range testdata {
+			_, err := decode(tc.data)
+			assert.ErrorIs(t, err, tc.cause, name, tc.name)
+
+			var de *DecodeError
+			if assert.ErrorAs(t, err, &de, name, tc.name) {
+				assert.Equal(t, tc.offset, de.Offset, name, tc.name)
+				assert.Equal(t, tc.section, de.Section, name, tc.name)
+				assert.Equal(t, tc.index, de.Index, name, tc.name)
+				assert.Equal(t, tc.shape, de.Shape, name, tc.name)
+			}
+		}
+
+		for i := range len(data) - 1 {
+			_, err := decode(data[:i])
+			assert.ErrorIs(t, err, ErrTruncated, name, i)
+		}
+	}
+}
+
+func readTestdata(f *testing.F) []*Image {
+	f.Helper()
+
+	files, err := filepath.Glob("testdata/*.hvif")
+	if err != nil {
+		f.Fatalf("listing testdata: %e", err)
+	}
+
+	var images []*Image
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			f.Fatalf("read file: %e", err)
+		}
+		f.Add(data)
+
+		img, err := ReadImage(bytes.NewReader(data))
+		if err != nil {
+			f.Fatalf("read image %s: %e", filename, err)
+		}
+		images = append(images, img)
+	}
+
+	return images
+}
+
+func FuzzReadImage(f *testing.F) {
+	readTestdata(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		img, err := ReadImage(bytes.NewReader(data))
+		if err != nil {
+			var de *DecodeError
+			assert.ErrorAs(t, err, &de)
+			return
+		}
+
+		styleless := false
+		for _, sp := range img.GetShapes() {
+			styleless = styleless || sp.Opaque == nil && img.GetShapeStyle(sp) == nil
+			img.GetShapePathes(sp)
+		}
+
+		// Shapes referencing missing styles cannot be written back
+		var buf bytes.Buffer
+		err = WriteImage(&buf, img)
+		if styleless {
+			assert.Error(t, err)
+			return
+		}
+		assert.NoError(t, err)
+		_, err = ReadImage(&buf)
+		assert.NoError(t, err)
+	})
+}
+
+func FuzzReadStyle(f *testing.F) {
+	for _, img := range readTestdata(f) {
+		for _, s := range img.GetStyles() {
+			var buf bytes.Buffer
+			if err := writeStyle(&buf, s); err != nil {
+				f.Fatalf("write style: %e", err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+
+	f.Fuzz(func(_ *testing.T, data []byte) {
+		_, _ = readStyle(newByteReader(data), true)
+	})
+}
+
+func FuzzReadPath(f *testing.F) {
+	for _, img := range readTestdata(f) {
+		for _, p := range img.GetPathes() {
+			var buf bytes.Buffer
+			if err := writePath(&buf, p); err != nil {
+				f.Fatalf("write path: %e", err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+
+	f.Fuzz(func(_ *testing.T, data []byte) {
+		_, _ = readPath(newByteReader(data), true)
+	})
+}
+
+func FuzzReadShape(f *testing.F) {
+	for _, img := range readTestdata(f) {
+		idx := newShapeIndex(img)
+		for _, sp := range img.GetShapes() {
+			var buf bytes.Buffer
+			if err := writeShape(&buf, sp, idx); err != nil {
+				f.Fatalf("write shape: %e", err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+
+	f.Fuzz(func(_ *testing.T, data []byte) {
+		_, _, _ = readShape(newByteReader(data), true)
+	})
+}
+
+func FuzzReadTransformer(f *testing.F) {
+	for _, img := range readTestdata(f) {
+		for _, sp := range img.GetShapes() {
+			_, _, list := sp.splitTransforms()
+			for _, tr := range list {
+				var buf bytes.Buffer
+				if err := writeTransformer(&buf, tr); err != nil {
+					f.Fatalf("write transformer: %e", err)
+				}
+				f.Add(buf.Bytes())
+			}
+		}
+	}
+
+	f.Fuzz(func(_ *testing.T, data []byte) {
+		_, _ = readTransformer(newByteReader(data))
+	})
+}
+
+func TestReadLenient(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.hvif")
+	if err != nil {
+		t.Fatalf("read file: %e", err)
+	}
+	shapeOffset := len(data) - 5
+
+	// Truncated in the middle of the shape section
+	img, warnings, err := ReadImageWithOptions(bytes.NewReader(data[:len(data)-2]), DecodeOptions{Lenient: true})
+	assert.NoError(t, err)
+	assert.Len(t, img.GetStyles(), 2)
+	assert.Len(t, img.GetPathes(), 1)
+	assert.Empty(t, img.GetShapes())
+	if assert.Len(t, warnings, 1) {
+		assert.ErrorIs(t, warnings[0], ErrTruncated)
+		assert.Equal(t, SectionShape, warnings[0].Section)
+	}
+
+	_, _, err = ReadImageWithOptions(bytes.NewReader(data[:len(data)-2]), DecodeOptions{})
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	// Dangling style and path references
+	dangling := slices.Clone(data)
+	dangling[shapeOffset+1] = 9
+	dangling = slices.Insert(dangling, shapeOffset+3, 7)
+	dangling[shapeOffset+2] = 2
+
+	img, warnings, err = ReadImageWithOptions(bytes.NewReader(dangling), DecodeOptions{Lenient: true})
+	assert.NoError(t, err)
+	if assert.Len(t, img.GetShapes(), 1) {
+		assert.Nil(t, img.GetShapes()[0].Style())
+		assert.Equal(t, []*Path{img.GetPathes()[0]}, img.GetShapes()[0].Paths())
+	}
+	if assert.Len(t, warnings, 2) {
+		assert.ErrorIs(t, warnings[0], ErrDanglingReference)
+		assert.Equal(t, int64(shapeOffset+1), warnings[0].Offset)
+		assert.ErrorIs(t, warnings[1], ErrDanglingReference)
+		assert.Equal(t, int64(shapeOffset+3), warnings[1].Offset)
+	}
+
+	_, _, err = ReadImageWithOptions(bytes.NewReader([]byte("ncfi")), DecodeOptions{Lenient: true})
+	assert.ErrorIs(t, err, ErrBadMagic)
+}
+
+func TestReadStrict(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.hvif")
+	if err != nil {
+		t.Fatalf("read file: %e", err)
+	}
+	shapeOffset := len(data) - 5
+
+	files, err := filepath.Glob("testdata/*.hvif")
+	if err != nil {
+		t.Fatalf("glob: %e", err)
+	}
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("read file: %e", err)
+		}
+		_, warnings, err := DecodeWithOptions(raw, DecodeOptions{Strict: true})
+		if filepath.Base(file) == "terminal.hvif" {
+			// Gradient stops of real icons are not necessarily sorted
+			assert.ErrorIs(t, err, ErrUnorderedOffsets, file)
+			continue
+		}
+		assert.NoError(t, err, file)
+		assert.Empty(t, warnings, file)
+	}
+
+	patch := func(offset int, b ...uint8) []byte {
+		d := slices.Clone(data)
+		copy(d[offset:], b)
+
+		return d
+	}
+
+	testdata := []struct {
+		name   string
+		data   []byte
+		opts   DecodeOptions
+		cause  error
+		offset int
+	}{
+		{"path flags", patch(14, 0x07), DecodeOptions{Strict: true}, ErrUnknownFlags, 14},
+		{"shape flags", patch(len(data)-1, 0x41), DecodeOptions{Strict: true}, ErrUnknownFlags, len(data) - 1},
+		{"style id", patch(shapeOffset+1, 2), DecodeOptions{Strict: true}, ErrDanglingReference, shapeOffset + 1},
+		{"path id", patch(shapeOffset+3, 1), DecodeOptions{Strict: true}, ErrDanglingReference, shapeOffset + 3},
+		{"trailing data", append(slices.Clone(data), 0), DecodeOptions{Strict: true}, ErrTrailingData, len(data)},
+		{"opaque shape", append(slices.Clone(data[:shapeOffset]), 0x0b, 1), DecodeOptions{Strict: true}, ErrUnknownShapeType, shapeOffset},
+		{"styles", data, DecodeOptions{MaxStyles: 1}, ErrLimitExceeded, 4},
+		{"pathes", append(patch(13, 2), data[14:34]...), DecodeOptions{MaxPathes: 1}, ErrLimitExceeded, 13},
+		{"shapes", append(patch(shapeOffset-1, 2), data[shapeOffset:]...), DecodeOptions{MaxShapes: 1}, ErrLimitExceeded, shapeOffset - 1},
+		{"elements", data, DecodeOptions{MaxElements: 4}, ErrLimitExceeded, 15},
+		{
+			"transformers", append(slices.Clone(data[:len(data)-1]), uint8(shapeFlagTranslation|shapeFlagLodScale), 0x20, 0x20, 0, 0xff),
+			DecodeOptions{MaxTransformers: 1}, ErrLimitExceeded, shapeOffset,
+		},
+	}
+
+	for _, tt := range testdata {
+		_, _, err := DecodeWithOptions(tt.data, tt.opts)
+		assert.ErrorIs(t, err, tt.cause, tt.name)
+		var de *DecodeError
+		if assert.ErrorAs(t, err, &de, tt.name) {
+			assert.Equal(t, int64(tt.offset), de.Offset, tt.name)
+		}
+
+		// Nothing is checked by default
+		if !errors.Is(tt.cause, ErrLimitExceeded) && !errors.Is(tt.cause, ErrUnknownShapeType) {
+			_, err = Decode(tt.data)
+			assert.NoError(t, err, tt.name)
+		}
+	}
+
+	// Lenient decoding drops what strict decoding rejects
+	img, warnings, err := DecodeWithOptions(patch(shapeOffset+1, 2), DecodeOptions{Strict: true, Lenient: true})
+	assert.NoError(t, err)
+	assert.Nil(t, img.GetShapes()[0].Style())
+	if assert.Len(t, warnings, 1) {
+		assert.ErrorIs(t, warnings[0], ErrDanglingReference)
+	}
+
+	var buf bytes.Buffer
+	gradient := &Gradient{Colors: make([]Color, 3), Offsets: []uint8{0, 200, 100}}
+	if err := writeStyle(&buf, gradient); err != nil {
+		t.Fatalf("write style: %e", err)
+	}
+	_, err = readStyle(newByteReader(buf.Bytes()), true)
+	assert.ErrorIs(t, err, ErrUnorderedOffsets)
+	_, err = readStyle(newByteReader(buf.Bytes()), false)
+	assert.NoError(t, err)
+}
+
+func TestReadOpaque(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.hvif")
+	if err != nil {
+		t.Fatalf("read file: %e", err)
+	}
+	shapeOffset := len(data) - 5
+
+	testdata := []struct {
+		name  string
+		data  []byte
+		cause error
+		check func(sp *Shape)
+	}{
+		{
+			"unknown shape", append(slices.Clone(data[:shapeOffset]), 0x0b, 1, 2, 3),
+			ErrUnknownShapeType,
+			func(sp *Shape) {
+				assert.Equal(t, &OpaqueRecord{Type: 0x0b, Data: []byte{1, 2, 3}}, sp.Opaque)
+			},
+		},
+		{
+			"unknown transformer", append(slices.Clone(data[:len(data)-1]), uint8(shapeFlagHasTransformers|shapeFlagHinting), 2, 0x17, 0x84, 0, 4, 0x63, 5),
+			ErrUnknownTransformer,
+			func(sp *Shape) {
+				assert.True(t, sp.Hinting)
+				assert.Equal(t, []Transformer{
+					&TransformerStroke{Width: 4, MiterLimit: 4},
+					&OpaqueRecord{Type: 0x63, Data: []byte{5}},
+				}, sp.Transforms)
+			},
+		},
+	}
+
+	for _, tc := range testdata {
+		img, warnings, err := DecodeWithOptions(tc.data, DecodeOptions{})
+		assert.NoError(t, err, tc.name)
+		if assert.Len(t, warnings, 1, tc.name) {
+			assert.ErrorIs(t, warnings[0], tc.cause, tc.name)
+		}
+		if assert.Len(t, img.GetShapes(), 1, tc.name) {
+			tc.check(img.GetShapes()[0])
+		}
+
+		var buf bytes.Buffer
+		assert.NoError(t, WriteImage(&buf, img), tc.name)
+		assert.Equal(t, tc.data[shapeOffset:], buf.Bytes()[shapeOffset:], tc.name)
+
+		img.AddShape(&Shape{style: img.GetStyles()[0]})
+		assert.Error(t, WriteImage(&buf, img), tc.name)
+
+	}
+}
+
+func TestDecodeMatchesReadImage(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.hvif")
+	if err != nil {
+		t.Fatalf("listing testdata: %e", err)
+	}
+
+	inputs := make(map[string][]byte, len(files)+1)
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("read file: %e", err)
+		}
+		inputs[filename] = data
+	}
+	// The last shape of test.hvif replaced by one of unknown type
+	data := inputs[filepath.Join("testdata", "test.hvif")]
+	inputs["trailing opaque shape"] = append(slices.Clone(data[:len(data)-5]), 0x0b, 1, 2, 3)
+
+	for name, data := range inputs {
+		expected, warnings, err := ReadImageWithOptions(iotest.OneByteReader(bytes.NewReader(data)), DecodeOptions{})
+		assert.NoError(t, err, name)
+		actual, actualWarnings, err := DecodeWithOptions(data, DecodeOptions{})
+		assert.NoError(t, err, name)
+		assert.Equal(t, expected, actual, name)
+		assert.Equal(t, warnings, actualWarnings, name)
+	}
+
+	img, err := ReadImage(bytes.NewReader(inputs["trailing opaque shape"]))
+	assert.NoError(t, err)
+	if assert.Len(t, img.GetShapes(), 1) {
+		assert.Equal(t, &OpaqueRecord{Type: 0x0b, Data: []byte{1, 2, 3}}, img.GetShapes()[0].Opaque)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	files, err := filepath.Glob("testdata/*.hvif")
+	if err != nil {
+		b.Fatalf("listing testdata: %e", err)
+	}
+
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			b.Fatalf("read file: %e", err)
+		}
+
+		b.Run(filepath.Base(filename)+"/Decode", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				if _, err := Decode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(filepath.Base(filename)+"/ReadImage", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				if _, err := ReadImage(bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
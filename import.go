@@ -0,0 +1,86 @@
+package hvif
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+type ImportOptions struct {
+	// Scale and then translation applied to the imported shapes. Scale of 0
+	// is the same as 1.
+	Scale float32
+	X, Y  float32
+}
+
+// place applies the options to the shape matrix, which the renderer applies
+// after the transformers list, so that strokes and gradients follow.
+func (opts ImportOptions) place(sp *Shape) {
+	scale := opts.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	if scale == 1 && opts.X == 0 && opts.Y == 0 {
+		return
+	}
+
+	_, header, list := sp.splitTransforms()
+	var lod Transformer
+	for _, t := range header {
+		if t, ok := t.(*TransformerLodScale); ok {
+			lod = t
+		}
+	}
+	matrix := shapeMatrix(header).Multiply(Scale(scale, scale)).Multiply(Translate(opts.X, opts.Y))
+
+	transforms := make([]Transformer, 0, len(list)+2)
+	transforms = append(transforms, headerTransformer(matrix))
+	if lod != nil {
+		transforms = append(transforms, lod)
+	}
+	sp.Transforms = append(transforms, list...)
+}
+
+// Import adds the shapes of other on top of the image's ones, together with
+// the styles and pathes they use. A last shape holding records of unknown
+// type stays the last one. The image is left unchanged if the result would
+// not fit in the file, or would hold such records anywhere else.
+func (i *Image) Import(other *Image, opts ImportOptions) error {
+	imported := other.Clone()
+	imported.Prune()
+
+	at := len(i.shapes)
+	if at > 0 && i.shapes[at-1].hasOpaque() {
+		at--
+	}
+	for shapeID, sp := range imported.shapes {
+		if sp.hasOpaque() && (shapeID != len(imported.shapes)-1 || at != len(i.shapes)) {
+			return fmt.Errorf("%w: imported shape [%d]", ErrMisplacedOpaque, shapeID)
+		}
+	}
+
+	for _, c := range []struct {
+		what string
+		n    int
+	}{
+		{"styles", len(i.styles) + len(imported.styles)},
+		{"pathes", len(i.pathes) + len(imported.pathes)},
+		{"shapes", len(i.shapes) + len(imported.shapes)},
+	} {
+		if c.n > math.MaxUint8 {
+			return fmt.Errorf("%w: %d %s", ErrTooManyEntries, c.n, c.what)
+		}
+	}
+
+	for _, sp := range imported.shapes {
+		if sp.Opaque == nil {
+			opts.place(sp)
+		}
+	}
+
+	i.styles = append(i.styles, imported.styles...)
+	i.pathes = append(i.pathes, imported.pathes...)
+	i.shapes = slices.Insert(i.shapes, at, imported.shapes...)
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package hvif
+
+import "slices"
+
+// Scale from which the maximum scale of a level of detail no longer hides
+// shapes, as in Haiku. It is also the largest scale the file can store.
+const lodNoMaxScale = 4
+
+// LodScale returns the range of render scales the shape is drawn at, ok is
+// false if it has no level of detail.
+func (s *Shape) LodScale() (minS, maxS float32, ok bool) {
+	_, header, _ := s.splitTransforms()
+	for _, t := range header {
+		if ls, ok := t.(*TransformerLodScale); ok {
+			return ls.MinS, ls.MaxS, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// SetLodScale limits the render scales the shape is drawn at, 1 being the
+// 64x64 size. Scales are clamped to [0, 4], a maximum of 4 does not limit
+// the scale.
+func (s *Shape) SetLodScale(minS, maxS float32) {
+	minS = min(max(minS, 0), lodNoMaxScale)
+	maxS = min(max(maxS, 0), lodNoMaxScale)
+	s.ClearLodScale()
+	_, header, _ := s.splitTransforms()
+	s.Transforms = slices.Insert(s.Transforms, len(header), Transformer(&TransformerLodScale{MinS: minS, MaxS: maxS}))
+}
+
+// ClearLodScale makes the shape drawn at every scale.
+func (s *Shape) ClearLodScale() {
+	s.Transforms = slices.DeleteFunc(s.Transforms, func(t Transformer) bool {
+		_, ok := t.(*TransformerLodScale)
+
+		return ok
+	})
+}
+
+// VisibleAt reports whether the level of detail of the shape lets it be drawn
+// at the render scale.
+func (s *Shape) VisibleAt(scale float32) bool {
+	minS, maxS, ok := s.LodScale()
+
+	return !ok || scale >= minS && (scale <= maxS || maxS >= lodNoMaxScale)
+}
+
+// VisibleShapes returns the shapes drawn at the render scale, 1 being the
+// 64x64 size, in drawing order. Opaque shapes are never drawn.
+func (i *Image) VisibleShapes(scale float32) []*Shape {
+	var res []*Shape
+	for _, sp := range i.shapes {
+		if sp.Opaque == nil && sp.VisibleAt(scale) {
+			res = append(res, sp)
+		}
+	}
+
+	return res
+}
+
+// AtScale returns a copy of the image holding only the shapes drawn at the
+// render scale, with the styles and pathes they use.
+func (i *Image) AtScale(scale float32) *Image {
+	img := i.Clone()
+	img.shapes = img.VisibleShapes(scale)
+	img.Prune()
+
+	return img
+}
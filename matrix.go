@@ -0,0 +1,167 @@
+package hvif
+
+import "math"
+
+// Matrix is an affine transformation stored as [sx, shy, shx, sy, tx, ty], in
+// the layout of TransformerAffine. A point is mapped to
+// (sx*x + shx*y + tx, shy*x + sy*y + ty).
+type Matrix [transformMatrixSize]float32
+
+func Identity() Matrix {
+	return Matrix{1, 0, 0, 1, 0, 0}
+}
+
+func Translate(x, y float32) Matrix {
+	return Matrix{1, 0, 0, 1, x, y}
+}
+
+func Scale(sx, sy float32) Matrix {
+	return Matrix{sx, 0, 0, sy, 0, 0}
+}
+
+// Rotate turns by angle radians, clockwise on screen.
+func Rotate(angle float32) Matrix {
+	sin, cos := math.Sincos(float64(angle))
+
+	return Matrix{float32(cos), float32(sin), float32(-sin), float32(cos), 0, 0}
+}
+
+// Skew slants by ax radians along the x axis and by ay along the y axis.
+func Skew(ax, ay float32) Matrix {
+	return Matrix{1, float32(math.Tan(float64(ay))), float32(math.Tan(float64(ax))), 1, 0, 0}
+}
+
+// Multiply returns the matrix applying m and then o.
+func (m Matrix) Multiply(o Matrix) Matrix {
+	return Matrix{
+		o[0]*m[0] + o[2]*m[1],
+		o[1]*m[0] + o[3]*m[1],
+		o[0]*m[2] + o[2]*m[3],
+		o[1]*m[2] + o[3]*m[3],
+		o[0]*m[4] + o[2]*m[5] + o[4],
+		o[1]*m[4] + o[3]*m[5] + o[5],
+	}
+}
+
+func (m Matrix) Apply(p Point) Point {
+	return Point{
+		X: m[0]*p.X + m[2]*p.Y + m[4],
+		Y: m[1]*p.X + m[3]*p.Y + m[5],
+	}
+}
+
+func (m Matrix) determinant() float32 {
+	return m[0]*m[3] - m[1]*m[2]
+}
+
+// Invert returns false for matrices collapsing the plane.
+func (m Matrix) Invert() (Matrix, bool) {
+	det := m.determinant()
+	if det == 0 {
+		return m, false
+	}
+
+	return Matrix{
+		m[3] / det,
+		-m[1] / det,
+		-m[2] / det,
+		m[0] / det,
+		(m[2]*m[5] - m[3]*m[4]) / det,
+		(m[1]*m[4] - m[0]*m[5]) / det,
+	}, true
+}
+
+func (m Matrix) IsIdentity() bool {
+	return m == Identity()
+}
+
+// Decomposition describes a matrix as a scale, followed by a skew along the x
+// axis, a rotation and a translation. Angles are in radians.
+type Decomposition struct {
+	ScaleX, ScaleY float32
+	Skew           float32
+	Rotation       float32
+	TranslateX     float32
+	TranslateY     float32
+}
+
+// Decompose is exact for matrices with a positive determinant, others get a
+// negative ScaleY.
+func (m Matrix) Decompose() Decomposition {
+	sx := math.Hypot(float64(m[0]), float64(m[1]))
+	rotation := math.Atan2(float64(m[1]), float64(m[0]))
+	sin, cos := math.Sincos(rotation)
+
+	// Undo the rotation of the second column
+	shear := cos*float64(m[2]) + sin*float64(m[3])
+	sy := -sin*float64(m[2]) + cos*float64(m[3])
+	var skew float64
+	if sy != 0 {
+		skew = math.Atan(shear / sy)
+	}
+
+	return Decomposition{
+		ScaleX: float32(sx), ScaleY: float32(sy),
+		Skew:       float32(skew),
+		Rotation:   float32(rotation),
+		TranslateX: m[4], TranslateY: m[5],
+	}
+}
+
+// Matrix composes the decomposition back.
+func (d Decomposition) Matrix() Matrix {
+	return Scale(d.ScaleX, d.ScaleY).
+		Multiply(Skew(d.Skew, 0)).
+		Multiply(Rotate(d.Rotation)).
+		Multiply(Translate(d.TranslateX, d.TranslateY))
+}
+
+// EffectiveMatrix folds the transformers moving the points of the shape into
+// one matrix: the affine transformers of the list in their order, followed by
+// the shape matrix. Stroke and contour transformers only change the outline.
+// It returns false if the shape has a perspective transformer.
+func (s *Shape) EffectiveMatrix() (Matrix, bool) {
+	_, header, list := s.splitTransforms()
+
+	m := Identity()
+	for _, t := range list {
+		switch t := t.(type) {
+		case *TransformerAffine:
+			m = m.Multiply(Matrix(t.Matrix))
+		case *TransformerPerspective:
+			return m, false
+		}
+	}
+
+	return m.Multiply(shapeMatrix(header)), true
+}
+
+// shapeMatrix returns the matrix the shape header stores, the translation
+// follows the affine transformation.
+func shapeMatrix(header []Transformer) Matrix {
+	m := Identity()
+	for _, t := range header {
+		switch t := t.(type) {
+		case *TransformerAffine:
+			m = m.Multiply(Matrix(t.Matrix))
+		case *TransformerTranslation:
+			m = m.Multiply(Translate(t.X, t.Y))
+		}
+	}
+
+	return m
+}
+
+// headerTransformer returns the transformer storing m in the shape header, a
+// translation if it only moves points.
+func headerTransformer(m Matrix) Transformer {
+	if m[0] == 1 && m[1] == 0 && m[2] == 0 && m[3] == 1 {
+		_, okX := QuantizeCoord(m[4])
+		_, okY := QuantizeCoord(m[5])
+		if okX && okY {
+			return &TransformerTranslation{X: m[4], Y: m[5]}
+		}
+	}
+
+	return &TransformerAffine{Matrix: m}
+}
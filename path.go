@@ -18,6 +18,8 @@ const (
 	pathFlagClosed pathFlag = 1 << (1 + iota)
 	pathFlagUsesCommands
 	pathFlagNoCurves
+
+	pathFlagsKnown = pathFlagClosed | pathFlagUsesCommands | pathFlagNoCurves
 )
 
 type pathCommandType uint8
@@ -29,7 +31,21 @@ const (
 	pathCommandCurve
 )
 
-type PathElement any // Point | HLine | VLine | Curve
+type ElementKind uint8
+
+const (
+	ElementKindPoint ElementKind = iota
+	ElementKindHLine
+	ElementKindVLine
+	ElementKindCurve
+)
+
+// PathElement is implemented by *Point, *HLine, *VLine and *Curve only.
+type PathElement interface {
+	Kind() ElementKind
+	Clone() PathElement
+	isPathElement()
+}
 
 type HLine struct {
 	X float32
@@ -50,12 +66,101 @@ type Curve struct {
 	PointOut Point
 }
 
+func (*HLine) Kind() ElementKind {
+	return ElementKindHLine
+}
+
+func (l *HLine) Clone() PathElement {
+	c := *l
+
+	return &c
+}
+
+func (*HLine) isPathElement() {}
+
+func (*VLine) Kind() ElementKind {
+	return ElementKindVLine
+}
+
+func (l *VLine) Clone() PathElement {
+	c := *l
+
+	return &c
+}
+
+func (*VLine) isPathElement() {}
+
+func (*Point) Kind() ElementKind {
+	return ElementKindPoint
+}
+
+func (p *Point) Clone() PathElement {
+	c := *p
+
+	return &c
+}
+
+func (*Point) isPathElement() {}
+
+func (*Curve) Kind() ElementKind {
+	return ElementKindCurve
+}
+
+func (c *Curve) Clone() PathElement {
+	cc := *c
+
+	return &cc
+}
+
+func (*Curve) isPathElement() {}
+
 type Path struct {
 	isClosed bool
 	Elements []PathElement
 }
 
-func readPoint(r io.Reader) (Point, error) {
+// Closed reports whether the last point is connected to the first one.
+func (p *Path) Closed() bool {
+	return p.isClosed
+}
+
+func (p *Path) SetClosed(closed bool) {
+	p.isClosed = closed
+}
+
+// Curves returns the path as cubic curves with absolute coordinates, the way
+// Haiku interprets it. Lines are curves with handles on their points. It
+// returns nil if the path has nil elements.
+func (p *Path) Curves() []Curve {
+	nodes, err := resolvePathElements(p.Elements)
+	if err != nil {
+		return nil
+	}
+
+	curves := make([]Curve, len(nodes))
+	for i, n := range nodes {
+		curves[i] = n.curve()
+	}
+
+	return curves
+}
+
+// Normalize replaces the elements of the path with the *Curve ones returned
+// by Curves. Pathes with nil elements are left unchanged.
+func (p *Path) Normalize() {
+	curves := p.Curves()
+	if curves == nil && len(p.Elements) > 0 {
+		return
+	}
+
+	elements := make([]PathElement, len(curves))
+	for i := range curves {
+		elements[i] = &curves[i]
+	}
+	p.Elements = elements
+}
+
+func readPoint(r *byteReader) (Point, error) {
 	var p Point
 	x, err := readFloatCoord(r)
 	if err != nil {
@@ -85,52 +190,54 @@ func splitCommandTypes(rawTypes []uint8, count uint8) []pathCommandType {
 	return pct
 }
 
-func readPath(r io.Reader) (Path, error) {
+func readPath(r *byteReader, strict bool) (Path, error) {
 	var path Path
-	var flag pathFlag
-	err := binary.Read(r, binary.LittleEndian, &flag)
+	rawFlag, err := r.readUint8()
 	if err != nil {
 		return path, fmt.Errorf("reading flags: %w", err)
 	}
+	if strict {
+		if err := checkFlags(rawFlag, uint8(pathFlagsKnown)); err != nil {
+			return path, fmt.Errorf("reading flags: %w", err)
+		}
+	}
+	flag := pathFlag(rawFlag)
 	path.isClosed = flag&pathFlagClosed != 0
 
 	switch {
 	case flag&pathFlagNoCurves != 0:
-		var count uint8
-		err := binary.Read(r, binary.LittleEndian, &count)
+		count, err := r.readUint8()
 		if err != nil {
 			return path, fmt.Errorf("reading count for path no curves: %w", err)
 		}
 
-		var points []PathElement
+		points := make([]PathElement, 0, count)
 		for i := byte(0); i < count; i++ {
 			p, err := readPoint(r)
 			if err != nil {
 				return path, fmt.Errorf("reading point: %w", err)
 			}
-			points = append(points, p)
+			points = append(points, &p)
 		}
 		path.Elements = points
 	case flag&pathFlagUsesCommands != 0:
-		var count uint8
-		err := binary.Read(r, binary.LittleEndian, &count)
+		count, err := r.readUint8()
 		if err != nil {
 			return path, fmt.Errorf("reading count for path with commands: %w", err)
 		}
 
 		// Each command is 2 bits, aligned in a byte
-		bytesForCommandTypes := uint8(math.Ceil(pathCommandSizeBits * float64(count) / byteSizeBits))
-		pathRawCommandTypes := make([]uint8, bytesForCommandTypes)
-		err = binary.Read(r, binary.LittleEndian, &pathRawCommandTypes)
+		bytesForCommandTypes := (pathCommandSizeBits*int(count) + byteSizeBits - 1) / byteSizeBits
+		pathRawCommandTypes, err := r.readBytes(bytesForCommandTypes)
 		if err != nil {
 			return path, fmt.Errorf("reading commands: %w", err)
 		}
 
 		pathCommandTypes := splitCommandTypes(pathRawCommandTypes, count)
 
-		var points []PathElement
+		points := make([]PathElement, 0, count)
 		for i := byte(0); i < count; i++ {
-			var line interface{}
+			var line PathElement
 			switch pathCommandTypes[i] {
 			case pathCommandHLine:
 				c, err := readFloatCoord(r)
@@ -162,12 +269,12 @@ func readPath(r io.Reader) (Path, error) {
 
 		path.Elements = points
 	default:
-		var count uint8
-		err := binary.Read(r, binary.LittleEndian, &count)
+		count, err := r.readUint8()
 		if err != nil {
 			return path, fmt.Errorf("reading count for curves: %w", err)
 		}
-		var points []PathElement
+
+		points := make([]PathElement, 0, count)
 		for i := byte(0); i < count; i++ {
 			c, err := readCurve(r)
 			if err != nil {
@@ -181,7 +288,7 @@ func readPath(r io.Reader) (Path, error) {
 	return path, nil
 }
 
-func readCurve(r io.Reader) (Curve, error) {
+func readCurve(r *byteReader) (Curve, error) {
 	var c Curve
 	p1, err := readPoint(r)
 	if err != nil {
@@ -196,5 +303,207 @@ func readCurve(r io.Reader) (Curve, error) {
 		return c, fmt.Errorf("reading third point: %w", err)
 	}
 
-	return Curve{p1, p2, p3}, nil
+	return Curve{PointIn: p2, Point: p1, PointOut: p3}, nil
+}
+
+func writePoint(w io.Writer, p Point) error {
+	if err := writeFloatCoord(w, p.X); err != nil {
+		return fmt.Errorf("writing x coord: %w", err)
+	}
+	if err := writeFloatCoord(w, p.Y); err != nil {
+		return fmt.Errorf("writing y coord: %w", err)
+	}
+
+	return nil
+}
+
+func writeCurve(w io.Writer, c Curve) error {
+	if err := writePoint(w, c.Point); err != nil {
+		return fmt.Errorf("writing first point: %w", err)
+	}
+	if err := writePoint(w, c.PointIn); err != nil {
+		return fmt.Errorf("writing second point: %w", err)
+	}
+	if err := writePoint(w, c.PointOut); err != nil {
+		return fmt.Errorf("writing third point: %w", err)
+	}
+
+	return nil
+}
+
+func joinCommandTypes(pct []pathCommandType) []uint8 {
+	const pctsPerByte = (byteSizeBits / pathCommandSizeBits)
+	rawTypes := make([]uint8, (len(pct)+pctsPerByte-1)/pctsPerByte)
+	for i, commandType := range pct {
+		segment := i / pctsPerByte
+		shift := i % pctsPerByte
+
+		rawTypes[segment] |= uint8(commandType) << (shift * pathCommandSizeBits)
+	}
+
+	return rawTypes
+}
+
+// pathNode is a path element with all coordinates resolved, as it is
+// interpreted by Haiku: lines have both control points at the node itself.
+type pathNode struct {
+	In    Point
+	Point Point
+	Out   Point
+}
+
+func lineNode(p Point) pathNode {
+	return pathNode{In: p, Point: p, Out: p}
+}
+
+func (n pathNode) curve() Curve {
+	return Curve{PointIn: n.In, Point: n.Point, PointOut: n.Out}
+}
+
+func (n pathNode) isLine() bool {
+	return n.In == n.Point && n.Out == n.Point
+}
+
+func resolvePathElements(elements []PathElement) ([]pathNode, error) {
+	nodes := make([]pathNode, 0, len(elements))
+
+	// HLine and VLine reuse a coordinate of the previous node
+	var last Point
+	for i, e := range elements {
+		var node pathNode
+		switch e := e.(type) {
+		case *HLine:
+			node = lineNode(Point{X: e.X, Y: last.Y})
+		case *VLine:
+			node = lineNode(Point{X: last.X, Y: e.Y})
+		case *Point:
+			node = lineNode(*e)
+		case *Curve:
+			node = pathNode{In: e.PointIn, Point: e.Point, Out: e.PointOut}
+		default:
+			return nil, fmt.Errorf("unknown path element [%d]: %T", i, e)
+		}
+		nodes = append(nodes, node)
+		last = node.Point
+	}
+
+	return nodes, nil
+}
+
+func pointSize(p Point) int {
+	return floatCoordSize(p.X) + floatCoordSize(p.Y)
+}
+
+func curveSize(n pathNode) int {
+	return pointSize(n.Point) + pointSize(n.In) + pointSize(n.Out)
+}
+
+// nodeCommand picks the shortest command able to represent the node.
+func nodeCommand(n pathNode, last Point) (pathCommandType, int) {
+	if !n.isLine() {
+		return pathCommandCurve, curveSize(n)
+	}
+
+	command, size := pathCommandLine, pointSize(n.Point)
+	if n.Point.Y == last.Y && floatCoordSize(n.Point.X) < size {
+		command, size = pathCommandHLine, floatCoordSize(n.Point.X)
+	}
+	if n.Point.X == last.X && floatCoordSize(n.Point.Y) < size {
+		command, size = pathCommandVLine, floatCoordSize(n.Point.Y)
+	}
+
+	return command, size
+}
+
+// choosePathLayout evaluates every layout supported by readPath and returns
+// the flag of the smallest one, together with the commands to use if the
+// command layout wins.
+func choosePathLayout(nodes []pathNode) (pathFlag, []pathCommandType) {
+	const pctsPerByte = (byteSizeBits / pathCommandSizeBits)
+
+	noCurves := true
+	noCurvesSize, curvesSize := 0, 0
+	commandsSize := (len(nodes) + pctsPerByte - 1) / pctsPerByte
+	commands := make([]pathCommandType, 0, len(nodes))
+
+	var last Point
+	for _, n := range nodes {
+		noCurves = noCurves && n.isLine()
+		noCurvesSize += pointSize(n.Point)
+		curvesSize += curveSize(n)
+
+		command, size := nodeCommand(n, last)
+		commands = append(commands, command)
+		commandsSize += size
+
+		last = n.Point
+	}
+
+	switch {
+	case noCurves && noCurvesSize <= curvesSize && noCurvesSize <= commandsSize:
+		return pathFlagNoCurves, nil
+	case curvesSize <= commandsSize:
+		return 0, nil
+	default:
+		return pathFlagUsesCommands, commands
+	}
+}
+
+func writePathNode(w io.Writer, n pathNode, command pathCommandType) error {
+	switch command {
+	case pathCommandHLine:
+		return writeFloatCoord(w, n.Point.X)
+	case pathCommandVLine:
+		return writeFloatCoord(w, n.Point.Y)
+	case pathCommandLine:
+		return writePoint(w, n.Point)
+	case pathCommandCurve:
+		return writeCurve(w, n.curve())
+	}
+
+	return fmt.Errorf("unknown command: %d", command)
+}
+
+func writePath(w io.Writer, p *Path) error {
+	if len(p.Elements) > math.MaxUint8 {
+		return fmt.Errorf("too many elements: %d", len(p.Elements))
+	}
+
+	nodes, err := resolvePathElements(p.Elements)
+	if err != nil {
+		return fmt.Errorf("resolving elements: %w", err)
+	}
+
+	flag, commands := choosePathLayout(nodes)
+	if p.isClosed {
+		flag |= pathFlagClosed
+	}
+
+	err = binary.Write(w, binary.LittleEndian, []uint8{uint8(flag), uint8(len(nodes))})
+	if err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+
+	if flag&pathFlagUsesCommands != 0 {
+		err := binary.Write(w, binary.LittleEndian, joinCommandTypes(commands))
+		if err != nil {
+			return fmt.Errorf("writing commands: %w", err)
+		}
+	}
+
+	for i, n := range nodes {
+		command := pathCommandCurve
+		switch {
+		case flag&pathFlagNoCurves != 0:
+			command = pathCommandLine
+		case flag&pathFlagUsesCommands != 0:
+			command = commands[i]
+		}
+
+		if err := writePathNode(w, n, command); err != nil {
+			return fmt.Errorf("writing element [%d]: %w", i, err)
+		}
+	}
+
+	return nil
 }
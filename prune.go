@@ -0,0 +1,41 @@
+package hvif
+
+// Prune removes the styles and pathes no shape uses, and returns them.
+func (i *Image) Prune() ([]Style, []*Path) {
+	usedStyles := make(map[Style]bool, len(i.styles))
+	usedPathes := make(map[*Path]bool, len(i.pathes))
+	for _, sp := range i.shapes {
+		if sp.style != nil {
+			usedStyles[sp.style] = true
+		}
+		for _, p := range sp.paths {
+			usedPathes[p] = true
+		}
+	}
+
+	var styles []Style
+	kept := i.styles[:0]
+	for _, s := range i.styles {
+		if usedStyles[s] {
+			kept = append(kept, s)
+		} else {
+			styles = append(styles, s)
+		}
+	}
+	clear(i.styles[len(kept):])
+	i.styles = kept
+
+	var pathes []*Path
+	keptPathes := i.pathes[:0]
+	for _, p := range i.pathes {
+		if usedPathes[p] {
+			keptPathes = append(keptPathes, p)
+		} else {
+			pathes = append(pathes, p)
+		}
+	}
+	clear(i.pathes[len(keptPathes):])
+	i.pathes = keptPathes
+
+	return styles, pathes
+}
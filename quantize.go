@@ -0,0 +1,124 @@
+package hvif
+
+// CoordLocation points at a coordinate inside of an image.
+type CoordLocation struct {
+	Path    int // Index of the path, -1 for shape coordinates
+	Shape   int // Index of the shape, -1 for path coordinates
+	Element int // Index of the path element or shape transformer
+	Value   float32
+}
+
+type QuantizeReport struct {
+	MaxError   float32
+	OutOfRange []CoordLocation
+}
+
+type quantizer struct {
+	report QuantizeReport
+	loc    CoordLocation
+}
+
+func (q *quantizer) coord(v *float32) {
+	qv, ok := QuantizeCoord(*v)
+	if !ok {
+		loc := q.loc
+		loc.Value = *v
+		q.report.OutOfRange = append(q.report.OutOfRange, loc)
+	}
+
+	if ok {
+		q.report.MaxError = max(q.report.MaxError, abs(qv-*v))
+	}
+	*v = qv
+}
+
+// float24 keeps values too large for float24 unchanged.
+func (q *quantizer) float24(v *float32) {
+	qv, err := QuantizeFloat24(*v)
+	if err != nil {
+		loc := q.loc
+		loc.Value = *v
+		q.report.OutOfRange = append(q.report.OutOfRange, loc)
+
+		return
+	}
+
+	q.report.MaxError = max(q.report.MaxError, abs(qv-*v))
+	*v = qv
+}
+
+func (q *quantizer) point(p *Point) {
+	q.coord(&p.X)
+	q.coord(&p.Y)
+}
+
+func (q *quantizer) curve(c *Curve) {
+	q.point(&c.PointIn)
+	q.point(&c.Point)
+	q.point(&c.PointOut)
+}
+
+// Quantize snaps every coordinate of the image to the nearest value that
+// survives encoding. Coordinates out of the representable range are clamped
+// and listed in the report, they are not accounted in MaxError.
+//
+// Shape headers are changed to the way they are written: an affine
+// transformation followed by a translation is folded into one transformer,
+// which is quantized as a float24 matrix unless it only translates.
+func (i *Image) Quantize() QuantizeReport {
+	var q quantizer
+
+	for pathID, p := range i.pathes {
+		for elementID, e := range p.Elements {
+			q.loc = CoordLocation{Path: pathID, Shape: -1, Element: elementID}
+			switch e := e.(type) {
+			case *Point:
+				q.point(e)
+			case *HLine:
+				q.coord(&e.X)
+			case *VLine:
+				q.coord(&e.Y)
+			case *Curve:
+				q.curve(e)
+			}
+		}
+	}
+
+	for shapeID, sp := range i.shapes {
+		if sp.Opaque != nil {
+			continue
+		}
+
+		_, split, _ := sp.splitTransforms()
+		_, header, list := sp.fileTransforms()
+		folded := len(header) < len(split)
+		if folded {
+			sp.Transforms = append(header, list...)
+		}
+
+		for transformerID, t := range header {
+			q.loc = CoordLocation{Path: -1, Shape: shapeID, Element: transformerID}
+			switch t := t.(type) {
+			case *TransformerTranslation:
+				q.coord(&t.X)
+				q.coord(&t.Y)
+			case *TransformerAffine:
+				if folded {
+					for i := range t.Matrix {
+						q.float24(&t.Matrix[i])
+					}
+				}
+			}
+		}
+	}
+
+	return q.report
+}
+
+func abs(v float32) float32 {
+	if v < 0 {
+		return -v
+	}
+
+	return v
+}
@@ -2,8 +2,11 @@ package hvif
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"slices"
 )
 
 type (
@@ -21,90 +24,332 @@ const (
 	shapeFlagLodScale
 	shapeFlagHasTransformers
 	shapeFlagTranslation
+
+	shapeFlagsKnown = shapeFlagTransform | shapeFlagHinting | shapeFlagLodScale |
+		shapeFlagHasTransformers | shapeFlagTranslation
 )
 
+// OpaqueRecord holds a shape or transformer of a type unknown to the package.
+// Its bytes are kept as found in the file and written back unchanged.
+type OpaqueRecord struct {
+	Type uint8
+	Data []byte
+}
+
 type Shape struct {
 	Hinting    bool
-	styleID    *uint8
-	pathIDs    []uint8
+	style      Style
+	paths      []*Path
 	Transforms []Transformer
+
+	// Opaque is set for shapes of unknown type, other fields are unused then
+	Opaque *OpaqueRecord
+}
+
+// Style returns nil if the shape has no style.
+func (s *Shape) Style() Style {
+	return s.style
+}
+
+func (s *Shape) Paths() []*Path {
+	return s.paths
+}
+
+// SetStyle makes the shape use the style, which has to be added to the image
+// too.
+func (s *Shape) SetStyle(style Style) {
+	s.style = style
+}
+
+// SetPaths replaces the pathes of the shape, they have to be added to the
+// image too.
+func (s *Shape) SetPaths(paths ...*Path) {
+	s.paths = slices.Clone(paths)
+}
+
+func (s *Shape) AddPath(p *Path) {
+	s.paths = append(s.paths, p)
 }
 
-func readShape(r io.Reader) (Shape, error) {
+// RemovePath removes every reference to p from the shape.
+func (s *Shape) RemovePath(p *Path) {
+	s.paths = slices.DeleteFunc(s.paths, func(sp *Path) bool {
+		return sp == p
+	})
+}
+
+// shapeRefs holds the style and path indices of a shape as stored in the file.
+type shapeRefs struct {
+	styleID uint8
+	pathIDs []uint8
+}
+
+func readShape(r *byteReader, strict bool) (Shape, shapeRefs, error) {
 	var shape Shape
-	var stype shapeType
+	var refs shapeRefs
+
+	rawType, err := r.readUint8()
+	if err != nil {
+		return shape, refs, fmt.Errorf("reading type: %w", err)
+	}
+	stype := shapeType(rawType)
 
-	err := binary.Read(r, binary.LittleEndian, &stype)
+	if stype != shapePathSource {
+		shape.Opaque = &OpaqueRecord{Type: uint8(stype)}
+
+		return shape, refs, fmt.Errorf("%w: %d", ErrUnknownShapeType, stype)
+	}
+
+	refs.styleID, err = r.readUint8()
 	if err != nil {
-		return shape, fmt.Errorf("reading type: %w", err)
+		return shape, refs, fmt.Errorf("reading style id: %w", err)
 	}
 
-	if stype == shapePathSource {
-		var styleID uint8
-		err := binary.Read(r, binary.LittleEndian, &styleID)
+	pathCount, err := r.readUint8()
+	if err != nil {
+		return shape, refs, fmt.Errorf("reading path count: %w", err)
+	}
+	if pathCount > 0 {
+		pathIDs, err := r.readBytes(int(pathCount))
 		if err != nil {
-			return shape, fmt.Errorf("reading style id: %w", err)
+			return shape, refs, fmt.Errorf("reading path ids: %w", err)
 		}
-		shape.styleID = &styleID
+		refs.pathIDs = slices.Clone(pathIDs)
+	}
 
-		var pathCount uint8
-		err = binary.Read(r, binary.LittleEndian, &pathCount)
+	rawFlags, err := r.readUint8()
+	if err != nil {
+		return shape, refs, fmt.Errorf("reading flags: %w", err)
+	}
+	if strict {
+		if err := checkFlags(rawFlags, uint8(shapeFlagsKnown)); err != nil {
+			return shape, refs, fmt.Errorf("reading flags: %w", err)
+		}
+	}
+	flags := shapeFlag(rawFlags)
+	if flags&shapeFlagHinting != 0 {
+		shape.Hinting = true
+	}
+	if flags&shapeFlagTransform != 0 {
+		t, err := readAffine(r)
 		if err != nil {
-			return shape, fmt.Errorf("reading path count: %w", err)
+			return shape, refs, fmt.Errorf("reading affine transformer: %w", err)
 		}
-		for i := byte(0); i < pathCount; i++ {
-			var pathID uint8
-			err := binary.Read(r, binary.LittleEndian, &pathID)
-			if err != nil {
-				return shape, fmt.Errorf("reading path [%d] id: %w", i, err)
-			}
-			shape.pathIDs = append(shape.pathIDs, pathID)
+		shape.Transforms = append(shape.Transforms, &t)
+	}
+	if flags&shapeFlagTranslation != 0 {
+		t, err := readTranslation(r)
+		if err != nil {
+			return shape, refs, fmt.Errorf("reading translation %w", err)
 		}
-
-		var flags shapeFlag
-		err = binary.Read(r, binary.LittleEndian, &flags)
+		shape.Transforms = append(shape.Transforms, &t)
+	}
+	if flags&shapeFlagLodScale != 0 {
+		t, err := readLodScale(r)
 		if err != nil {
-			return shape, fmt.Errorf("reading flags: %w", err)
+			return shape, refs, fmt.Errorf("reading lod scale: %w", err)
 		}
-		if flags&shapeFlagTransform != 0 {
-			t, err := readAffine(r)
-			if err != nil {
-				return shape, fmt.Errorf("reading affine transformer: %w", err)
-			}
-			shape.Transforms = append(shape.Transforms, &t)
+		shape.Transforms = append(shape.Transforms, &t)
+	}
+	if flags&shapeFlagHasTransformers != 0 {
+		count, err := r.readUint8()
+		if err != nil {
+			return shape, refs, fmt.Errorf("reading transformers count: %w", err)
 		}
-		if flags&shapeFlagTranslation != 0 {
-			t, err := readTranslation(r)
+		for i := range count {
+			t, err := readTransformer(r)
 			if err != nil {
-				return shape, fmt.Errorf("reading translation %w", err)
+				// Kept for the decoder to fill, if it is the last one
+				if t, ok := t.(*OpaqueRecord); ok {
+					shape.Transforms = append(shape.Transforms, t)
+				}
+
+				return shape, refs, &transformerError{index: int(i), last: i == count-1, err: err}
 			}
-			shape.Transforms = append(shape.Transforms, &t)
+			shape.Transforms = append(shape.Transforms, t)
 		}
-		if flags&shapeFlagLodScale != 0 {
-			t, err := readLodScale(r)
-			if err != nil {
-				return shape, fmt.Errorf("reading lod scale: %w", err)
-			}
-			shape.Transforms = append(shape.Transforms, &t)
+	}
+
+	return shape, refs, nil
+}
+
+// splitTransforms separates the transformers stored in the shape header
+// (affine, translation and lod scale, in this order) from the generic
+// transformers list, mirroring the layout used by readShape.
+func (s *Shape) splitTransforms() (flags shapeFlag, header []Transformer, list []Transformer) {
+	rest := s.Transforms
+	if len(rest) > 0 {
+		if _, ok := rest[0].(*TransformerAffine); ok {
+			flags |= shapeFlagTransform
+			header, rest = append(header, rest[0]), rest[1:]
 		}
-		if flags&shapeFlagHasTransformers != 0 {
-			var count uint8
-			err := binary.Read(r, binary.LittleEndian, &count)
-			if err != nil {
-				return shape, fmt.Errorf("reading transformers count: %w", err)
+	}
+	if len(rest) > 0 {
+		if _, ok := rest[0].(*TransformerTranslation); ok {
+			flags |= shapeFlagTranslation
+			header, rest = append(header, rest[0]), rest[1:]
+		}
+	}
+	if len(rest) > 0 {
+		if _, ok := rest[0].(*TransformerLodScale); ok {
+			flags |= shapeFlagLodScale
+			header, rest = append(header, rest[0]), rest[1:]
+		}
+	}
+	if len(rest) > 0 {
+		flags |= shapeFlagHasTransformers
+	}
+
+	return flags, header, rest
+}
+
+// fileTransforms is splitTransforms with the affine transformation and the
+// translation of the header folded into one, as Haiku reads only one of them.
+func (s *Shape) fileTransforms() (flags shapeFlag, header []Transformer, list []Transformer) {
+	flags, header, list = s.splitTransforms()
+	if flags&shapeFlagTransform == 0 || flags&shapeFlagTranslation == 0 {
+		return flags, header, list
+	}
+
+	folded := headerTransformer(shapeMatrix(header))
+	flags &^= shapeFlagTransform | shapeFlagTranslation
+	if _, ok := folded.(*TransformerTranslation); ok {
+		flags |= shapeFlagTranslation
+	} else {
+		flags |= shapeFlagTransform
+	}
+
+	return flags, append([]Transformer{folded}, header[2:]...), list
+}
+
+// hasOpaque reports whether the shape holds records of unknown length, which
+// can only be stored at the very end of the file.
+func (s *Shape) hasOpaque() bool {
+	for _, t := range s.Transforms {
+		if _, ok := t.(*OpaqueRecord); ok {
+			return true
+		}
+	}
+
+	return s.Opaque != nil
+}
+
+// shapeIndex maps styles and pathes of an image to their indices in the file.
+type shapeIndex struct {
+	styles map[Style]uint8
+	pathes map[*Path]uint8
+}
+
+// newShapeIndex expects the styles and pathes to be already validated by
+// writing them.
+func newShapeIndex(img *Image) *shapeIndex {
+	idx := &shapeIndex{
+		styles: make(map[Style]uint8, len(img.styles)),
+		pathes: make(map[*Path]uint8, len(img.pathes)),
+	}
+	for i, s := range img.styles {
+		if _, ok := idx.styles[s]; !ok {
+			idx.styles[s] = uint8(i)
+		}
+	}
+	for i, p := range img.pathes {
+		if _, ok := idx.pathes[p]; !ok {
+			idx.pathes[p] = uint8(i)
+		}
+	}
+
+	return idx
+}
+
+func (idx *shapeIndex) resolve(s *Shape) (shapeRefs, error) {
+	var refs shapeRefs
+
+	if s.style == nil {
+		return refs, errors.New("shape has no style")
+	}
+	styleID, ok := idx.styles[s.style]
+	if !ok {
+		return refs, errors.New("style is not in the image")
+	}
+	refs.styleID = styleID
+
+	refs.pathIDs = make([]uint8, len(s.paths))
+	for i, p := range s.paths {
+		pathID, ok := idx.pathes[p]
+		if !ok {
+			return refs, fmt.Errorf("path [%d] is not in the image", i)
+		}
+		refs.pathIDs[i] = pathID
+	}
+
+	return refs, nil
+}
+
+func writeShape(w io.Writer, s *Shape, idx *shapeIndex) error {
+	if s.Opaque != nil {
+		if err := writeOpaque(w, s.Opaque); err != nil {
+			return fmt.Errorf("writing opaque shape: %w", err)
+		}
+
+		return nil
+	}
+	if len(s.paths) > math.MaxUint8 {
+		return fmt.Errorf("too many pathes: %d", len(s.paths))
+	}
+	refs, err := idx.resolve(s)
+	if err != nil {
+		return fmt.Errorf("resolving references: %w", err)
+	}
+
+	err = binary.Write(w, binary.LittleEndian, []uint8{uint8(shapePathSource), refs.styleID, uint8(len(refs.pathIDs))})
+	if err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, refs.pathIDs); err != nil {
+		return fmt.Errorf("writing path ids: %w", err)
+	}
+
+	flags, header, list := s.fileTransforms()
+	if s.Hinting {
+		flags |= shapeFlagHinting
+	}
+	if err := binary.Write(w, binary.LittleEndian, flags); err != nil {
+		return fmt.Errorf("writing flags: %w", err)
+	}
+
+	for _, t := range header {
+		switch t := t.(type) {
+		case *TransformerAffine:
+			if err := writeAffine(w, t); err != nil {
+				return fmt.Errorf("writing affine transformer: %w", err)
 			}
-			for i := range count {
-				t, err := readTransformer(r)
-				if err != nil {
-					return shape, fmt.Errorf("reading transformer [%d]: %w", i, err)
-				}
-				shape.Transforms = append(shape.Transforms, t)
+		case *TransformerTranslation:
+			if err := writeTranslation(w, t); err != nil {
+				return fmt.Errorf("writing translation: %w", err)
 			}
+		case *TransformerLodScale:
+			if err := writeLodScale(w, t); err != nil {
+				return fmt.Errorf("writing lod scale: %w", err)
+			}
+		}
+	}
+
+	if len(list) > 0 {
+		if len(list) > math.MaxUint8 {
+			return fmt.Errorf("too many transformers: %d", len(list))
 		}
-		if flags&shapeFlagHinting != 0 {
-			shape.Hinting = true
+		if err := binary.Write(w, binary.LittleEndian, uint8(len(list))); err != nil {
+			return fmt.Errorf("writing transformers count: %w", err)
+		}
+		for i, t := range list {
+			if _, ok := t.(*OpaqueRecord); ok && i != len(list)-1 {
+				return fmt.Errorf("opaque transformer [%d] is not the last one", i)
+			}
+			if err := writeTransformer(w, t); err != nil {
+				return fmt.Errorf("writing transformer [%d]: %w", i, err)
+			}
 		}
 	}
 
-	return shape, nil
+	return nil
 }
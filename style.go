@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"slices"
 )
 
 type styleType uint8
@@ -35,9 +37,23 @@ const (
 	gradientFlagNoAlpha
 	gradientFlag16BitColors // Unused
 	gradientFlagGrays
+
+	gradientFlagsKnown = gradientFlagTransform | gradientFlagNoAlpha | gradientFlag16BitColors | gradientFlagGrays
+)
+
+type StyleKind uint8
+
+const (
+	StyleKindColor StyleKind = iota
+	StyleKindGradient
 )
 
-type Style any // Color | Gradient
+// Style is implemented by *Color and *Gradient only.
+type Style interface {
+	Kind() StyleKind
+	Clone() Style
+	isStyle()
+}
 
 type Color struct {
 	Red   uint8
@@ -53,6 +69,36 @@ type Gradient struct {
 	Offsets       []uint8
 }
 
+func (*Color) Kind() StyleKind {
+	return StyleKindColor
+}
+
+func (c *Color) Clone() Style {
+	cc := *c
+
+	return &cc
+}
+
+func (*Color) isStyle() {}
+
+func (*Gradient) Kind() StyleKind {
+	return StyleKindGradient
+}
+
+func (g *Gradient) Clone() Style {
+	cg := *g
+	if g.Transformable != nil {
+		t := *g.Transformable
+		cg.Transformable = &t
+	}
+	cg.Colors = slices.Clone(g.Colors)
+	cg.Offsets = slices.Clone(g.Offsets)
+
+	return &cg
+}
+
+func (*Gradient) isStyle() {}
+
 type solidColor struct {
 	Red   uint8
 	Green uint8
@@ -112,24 +158,27 @@ func (sgna solidGrayNoAlpha) toColor() Color {
 	}
 }
 
-func readGradient(r io.Reader) (Gradient, error) {
+func readGradient(r *byteReader, strict bool) (Gradient, error) {
 	var gradient Gradient
 
-	var gradientType GradientType
-	err := binary.Read(r, binary.LittleEndian, &gradientType)
+	gradientType, err := r.readUint8()
 	if err != nil {
 		return gradient, fmt.Errorf("reading type: %w", err)
 	}
-	gradient.Type = gradientType
+	gradient.Type = GradientType(gradientType)
 
-	var gradientFlags gradientFlag
-	err = binary.Read(r, binary.LittleEndian, &gradientFlags)
+	rawFlags, err := r.readUint8()
 	if err != nil {
 		return gradient, fmt.Errorf("reading flags: %w", err)
 	}
+	if strict {
+		if err := checkFlags(rawFlags, uint8(gradientFlagsKnown)); err != nil {
+			return gradient, fmt.Errorf("reading flags: %w", err)
+		}
+	}
+	gradientFlags := gradientFlag(rawFlags)
 
-	var ncolors uint8
-	err = binary.Read(r, binary.LittleEndian, &ncolors)
+	ncolors, err := r.readUint8()
 	if err != nil {
 		return gradient, fmt.Errorf("reading number of colors: %w", err)
 	}
@@ -142,12 +191,18 @@ func readGradient(r io.Reader) (Gradient, error) {
 		gradient.Transformable = &t
 	}
 
+	if ncolors > 0 {
+		gradient.Colors = make([]Color, 0, ncolors)
+		gradient.Offsets = make([]uint8, 0, ncolors)
+	}
 	for colorID := byte(0); colorID < ncolors; colorID++ {
-		var offset uint8
-		err := binary.Read(r, binary.LittleEndian, &offset)
+		offset, err := r.readUint8()
 		if err != nil {
 			return gradient, fmt.Errorf("reading [%d] offset: %w", colorID, err)
 		}
+		if strict && colorID > 0 && offset < gradient.Offsets[colorID-1] {
+			return gradient, fmt.Errorf("%w: [%d] offset %d", ErrUnorderedOffsets, colorID, offset)
+		}
 
 		var cType styleType
 		switch {
@@ -175,38 +230,38 @@ func readGradient(r io.Reader) (Gradient, error) {
 	return gradient, nil
 }
 
-func readColor(r io.Reader, cType styleType) (Color, error) {
+func readColor(r *byteReader, cType styleType) (Color, error) {
 	switch cType {
 	case styleSolidColor:
-		var s solidColor
-		err := binary.Read(r, binary.LittleEndian, &s)
+		b, err := r.readBytes(4)
 		if err != nil {
 			return Color{}, fmt.Errorf("reading solid color: %w", err)
 		}
+		s := solidColor{Red: b[0], Green: b[1], Blue: b[2], Alpha: b[3]}
 
 		return s.toColor(), nil
 	case styleSolidColorNoAlpha:
-		var sna solidColorNoAlpha
-		err := binary.Read(r, binary.LittleEndian, &sna)
+		b, err := r.readBytes(3)
 		if err != nil {
 			return Color{}, fmt.Errorf("reading solid color without alpha: %w", err)
 		}
+		sna := solidColorNoAlpha{Red: b[0], Green: b[1], Blue: b[2]}
 
 		return sna.toColor(), nil
 	case styleSolidGray:
-		var sg solidGray
-		err := binary.Read(r, binary.LittleEndian, &sg)
+		b, err := r.readBytes(2)
 		if err != nil {
 			return Color{}, fmt.Errorf("reading solid gray color: %w", err)
 		}
+		sg := solidGray{Gray: b[0], Alpha: b[1]}
 
 		return sg.toColor(), nil
 	case styleSolidGrayNoAlpha:
-		var sgna solidGrayNoAlpha
-		err := binary.Read(r, binary.LittleEndian, &sgna)
+		gray, err := r.readUint8()
 		if err != nil {
 			return Color{}, fmt.Errorf("reading solid gray color without alpha: %w", err)
 		}
+		sgna := solidGrayNoAlpha{Gray: gray}
 
 		return sgna.toColor(), nil
 	case styleGradient:
@@ -216,12 +271,12 @@ func readColor(r io.Reader, cType styleType) (Color, error) {
 	return Color{}, fmt.Errorf("color %d not recognized", cType)
 }
 
-func readStyle(r io.Reader) (Style, error) {
-	var styleType styleType
-	err := binary.Read(r, binary.LittleEndian, &styleType)
+func readStyle(r *byteReader, strict bool) (Style, error) {
+	rawType, err := r.readUint8()
 	if err != nil {
 		return nil, fmt.Errorf("reading style type: %w", err)
 	}
+	styleType := styleType(rawType)
 
 	switch styleType {
 	case styleSolidColor, styleSolidColorNoAlpha, styleSolidGray, styleSolidGrayNoAlpha:
@@ -232,7 +287,7 @@ func readStyle(r io.Reader) (Style, error) {
 
 		return &c, nil
 	case styleGradient:
-		gradient, err := readGradient(r)
+		gradient, err := readGradient(r, strict)
 		if err != nil {
 			return nil, fmt.Errorf("reading gradient: %w", err)
 		}
@@ -240,5 +295,135 @@ func readStyle(r io.Reader) (Style, error) {
 		return &gradient, nil
 	}
 
-	return nil, fmt.Errorf("unknown style: %d", styleType)
+	return nil, fmt.Errorf("%w: %d", ErrUnknownStyleType, styleType)
+}
+
+func writeColor(w io.Writer, c Color, cType styleType) error {
+	var err error
+	switch cType {
+	case styleSolidColor:
+		err = binary.Write(w, binary.LittleEndian, solidColor(c))
+	case styleSolidColorNoAlpha:
+		err = binary.Write(w, binary.LittleEndian, solidColorNoAlpha{Red: c.Red, Green: c.Green, Blue: c.Blue})
+	case styleSolidGray:
+		err = binary.Write(w, binary.LittleEndian, solidGray{Gray: c.Red, Alpha: c.Alpha})
+	case styleSolidGrayNoAlpha:
+		err = binary.Write(w, binary.LittleEndian, solidGrayNoAlpha{Gray: c.Red})
+	case styleGradient:
+		return errors.New("gradient is not a color")
+	default:
+		return fmt.Errorf("color %d not recognized", cType)
+	}
+	if err != nil {
+		return fmt.Errorf("writing color: %w", err)
+	}
+
+	return nil
+}
+
+func (c Color) isGray() bool {
+	return c.Red == c.Green && c.Green == c.Blue
+}
+
+func (c Color) isOpaque() bool {
+	return c.Alpha == 0xff
+}
+
+// colorType returns the narrowest color representation able to store c.
+func colorType(c Color) styleType {
+	switch {
+	case c.isGray() && c.isOpaque():
+		return styleSolidGrayNoAlpha
+	case c.isGray():
+		return styleSolidGray
+	case c.isOpaque():
+		return styleSolidColorNoAlpha
+	default:
+		return styleSolidColor
+	}
+}
+
+func writeGradient(w io.Writer, g *Gradient) error {
+	if len(g.Colors) != len(g.Offsets) {
+		return fmt.Errorf("gradient has %d colors and %d offsets", len(g.Colors), len(g.Offsets))
+	}
+	if len(g.Colors) > math.MaxUint8 {
+		return fmt.Errorf("too many colors: %d", len(g.Colors))
+	}
+
+	var gradientFlags gradientFlag
+	if g.Transformable != nil {
+		gradientFlags |= gradientFlagTransform
+	}
+
+	grays, noAlpha := true, true
+	for _, color := range g.Colors {
+		grays = grays && color.isGray()
+		noAlpha = noAlpha && color.isOpaque()
+	}
+
+	cType := styleSolidColor
+	switch {
+	case grays && noAlpha:
+		gradientFlags |= gradientFlagGrays | gradientFlagNoAlpha
+		cType = styleSolidGrayNoAlpha
+	case grays:
+		gradientFlags |= gradientFlagGrays
+		cType = styleSolidGray
+	case noAlpha:
+		gradientFlags |= gradientFlagNoAlpha
+		cType = styleSolidColorNoAlpha
+	}
+
+	err := binary.Write(w, binary.LittleEndian, []uint8{uint8(g.Type), uint8(gradientFlags), uint8(len(g.Colors))})
+	if err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+
+	if g.Transformable != nil {
+		if err := writeAffine(w, g.Transformable); err != nil {
+			return fmt.Errorf("writing affine transformer: %w", err)
+		}
+	}
+
+	for colorID, color := range g.Colors {
+		err := binary.Write(w, binary.LittleEndian, g.Offsets[colorID])
+		if err != nil {
+			return fmt.Errorf("writing [%d] offset: %w", colorID, err)
+		}
+
+		if err := writeColor(w, color, cType); err != nil {
+			return fmt.Errorf("writing color [%d]: %w", colorID, err)
+		}
+	}
+
+	return nil
+}
+
+func writeStyle(w io.Writer, s Style) error {
+	switch s := s.(type) {
+	case *Color:
+		cType := colorType(*s)
+		err := binary.Write(w, binary.LittleEndian, cType)
+		if err != nil {
+			return fmt.Errorf("writing style type: %w", err)
+		}
+		if err := writeColor(w, *s, cType); err != nil {
+			return fmt.Errorf("writing color: %w", err)
+		}
+
+		return nil
+	case *Gradient:
+		err := binary.Write(w, binary.LittleEndian, styleGradient)
+		if err != nil {
+			return fmt.Errorf("writing style type: %w", err)
+		}
+		if err := writeGradient(w, s); err != nil {
+			return fmt.Errorf("writing gradient: %w", err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown style: %T", s)
 }
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"slices"
 )
 
 const (
@@ -38,9 +40,28 @@ const (
 	transformerTypeStroke
 )
 
-// TransformerTranslation | TransformerLodScale | TransformerAffine |
-// TransformerPerspective | TransformerContour | TransformerStroke
-type Transformer any
+type TransformerKind uint8
+
+const (
+	TransformerKindTranslation TransformerKind = iota
+	TransformerKindLodScale
+	TransformerKindAffine
+	TransformerKindPerspective
+	TransformerKindContour
+	TransformerKindStroke
+	TransformerKindOpaque
+)
+
+// Transformer is implemented by *TransformerTranslation, *TransformerLodScale,
+// *TransformerAffine, *TransformerPerspective, *TransformerContour,
+// *TransformerStroke and *OpaqueRecord only.
+type Transformer interface {
+	Kind() TransformerKind
+	Clone() Transformer
+	// Apply maps a point, transformers not moving points return it as is.
+	Apply(p Point) Point
+	isTransformer()
+}
 
 type TransformerTranslation struct {
 	X float32
@@ -60,6 +81,88 @@ type TransformerPerspective struct {
 	Matrix [perspectiveMatrixSize]float32
 }
 
+func (*TransformerTranslation) Kind() TransformerKind {
+	return TransformerKindTranslation
+}
+
+func (t *TransformerTranslation) Clone() Transformer {
+	c := *t
+
+	return &c
+}
+
+func (t *TransformerTranslation) Apply(p Point) Point {
+	return Point{X: p.X + t.X, Y: p.Y + t.Y}
+}
+
+func (*TransformerTranslation) isTransformer() {}
+
+func (*TransformerLodScale) Kind() TransformerKind {
+	return TransformerKindLodScale
+}
+
+func (t *TransformerLodScale) Clone() Transformer {
+	c := *t
+
+	return &c
+}
+
+func (*TransformerLodScale) Apply(p Point) Point {
+	return p
+}
+
+func (*TransformerLodScale) isTransformer() {}
+
+func (*TransformerAffine) Kind() TransformerKind {
+	return TransformerKindAffine
+}
+
+func (t *TransformerAffine) Clone() Transformer {
+	c := *t
+
+	return &c
+}
+
+// Apply uses the matrix as [sx, shy, shx, sy, tx, ty].
+func (t *TransformerAffine) Apply(p Point) Point {
+	return Matrix(t.Matrix).Apply(p)
+}
+
+func (*TransformerAffine) isTransformer() {}
+
+func (*TransformerPerspective) Kind() TransformerKind {
+	return TransformerKindPerspective
+}
+
+func (t *TransformerPerspective) Clone() Transformer {
+	c := *t
+
+	return &c
+}
+
+// Apply uses the matrix as [sx, shy, w0, shx, sy, w1, tx, ty, w2].
+func (t *TransformerPerspective) Apply(p Point) Point {
+	m := t.Matrix
+	w := m[2]*p.X + m[5]*p.Y + m[8]
+
+	return Point{
+		X: (m[0]*p.X + m[3]*p.Y + m[6]) / w,
+		Y: (m[1]*p.X + m[4]*p.Y + m[7]) / w,
+	}
+}
+
+func (*TransformerPerspective) isTransformer() {}
+
+// IsExact reports whether the matrix is stored in the file without loss.
+func (t *TransformerAffine) IsExact() bool {
+	return isMatrixExact(t.Matrix[:])
+}
+
+// IsExact reports whether the matrix is stored in the file without loss.
+func (t *TransformerPerspective) IsExact() bool {
+	return isMatrixExact(t.Matrix[:])
+}
+
 type TransformerContour struct {
 	Width      float32
 	LineJoin   LineJoinOptions
@@ -73,34 +176,80 @@ type TransformerStroke struct {
 	MiterLimit float32
 }
 
-func readAffine(r io.Reader) (TransformerAffine, error) {
+func (*TransformerContour) Kind() TransformerKind {
+	return TransformerKindContour
+}
+
+func (t *TransformerContour) Clone() Transformer {
+	c := *t
+
+	return &c
+}
+
+// Apply returns the point as is, contours change the outline instead.
+func (*TransformerContour) Apply(p Point) Point {
+	return p
+}
+
+func (*TransformerContour) isTransformer() {}
+
+func (*TransformerStroke) Kind() TransformerKind {
+	return TransformerKindStroke
+}
+
+func (t *TransformerStroke) Clone() Transformer {
+	c := *t
+
+	return &c
+}
+
+// Apply returns the point as is, strokes change the outline instead.
+func (*TransformerStroke) Apply(p Point) Point {
+	return p
+}
+
+func (*TransformerStroke) isTransformer() {}
+
+func (*OpaqueRecord) Kind() TransformerKind {
+	return TransformerKindOpaque
+}
+
+func (o *OpaqueRecord) Clone() Transformer {
+	return &OpaqueRecord{Type: o.Type, Data: slices.Clone(o.Data)}
+}
+
+func (*OpaqueRecord) Apply(p Point) Point {
+	return p
+}
+
+func (*OpaqueRecord) isTransformer() {}
+
+func readAffine(r *byteReader) (TransformerAffine, error) {
 	var t TransformerAffine
-	mx, err := readMatrix(r, transformMatrixSize)
-	if err != nil {
+	if err := readMatrix(r, t.Matrix[:]); err != nil {
 		return t, fmt.Errorf("reading matrix: %w", err)
 	}
-	copy(t.Matrix[:], mx)
 
 	return t, nil
 }
 
-func readCountour(r io.Reader) (TransformerContour, error) {
+func readCountour(r *byteReader) (TransformerContour, error) {
 	var t TransformerContour
 
-	var width uint8
-	if err := binary.Read(r, binary.LittleEndian, &width); err != nil {
+	width, err := r.readUint8()
+	if err != nil {
 		return t, fmt.Errorf("reading width: %w", err)
 	}
 	t.Width = (float32(width) - 128.0)
 
-	var lineJoin uint8
-	if err := binary.Read(r, binary.LittleEndian, &lineJoin); err != nil {
+	lineJoin, err := r.readUint8()
+	if err != nil {
 		return t, fmt.Errorf("reading line join options: %w", err)
 	}
 	t.LineJoin = LineJoinOptions(lineJoin)
 
-	var miterLimit uint8
-	if err := binary.Read(r, binary.LittleEndian, &miterLimit); err != nil {
+	miterLimit, err := r.readUint8()
+	if err != nil {
 		return t, fmt.Errorf("reading miter limit: %w", err)
 	}
 	t.MiterLimit = float32(miterLimit)
@@ -108,35 +257,33 @@ func readCountour(r io.Reader) (TransformerContour, error) {
 	return t, nil
 }
 
-func readTransformerPerspective(r io.Reader) (TransformerPerspective, error) {
+func readTransformerPerspective(r *byteReader) (TransformerPerspective, error) {
 	var t TransformerPerspective
-	mx, err := readMatrix(r, perspectiveMatrixSize)
-	if err != nil {
+	if err := readMatrix(r, t.Matrix[:]); err != nil {
 		return t, fmt.Errorf("reading matrix: %w", err)
 	}
-	copy(t.Matrix[:], mx)
 
 	return t, nil
 }
 
-func readTransformerStroke(r io.Reader) (TransformerStroke, error) {
+func readTransformerStroke(r *byteReader) (TransformerStroke, error) {
 	var t TransformerStroke
 
-	var width uint8
-	if err := binary.Read(r, binary.LittleEndian, &width); err != nil {
+	width, err := r.readUint8()
+	if err != nil {
 		return t, fmt.Errorf("reading width: %w", err)
 	}
 	t.Width = (float32(width) - 128.0)
 
-	var lineOptions uint8
-	if err := binary.Read(r, binary.LittleEndian, &lineOptions); err != nil {
+	lineOptions, err := r.readUint8()
+	if err != nil {
 		return t, fmt.Errorf("reading line options: %w", err)
 	}
 	t.LineJoin = LineJoinOptions(lineOptions & 15)
 	t.LineCap = LineCapOptions(lineOptions >> 4)
 
-	var miterLimit uint8
-	if err := binary.Read(r, binary.LittleEndian, &miterLimit); err != nil {
+	miterLimit, err := r.readUint8()
+	if err != nil {
 		return t, fmt.Errorf("reading miter limit: %w", err)
 	}
 	t.MiterLimit = float32(miterLimit)
@@ -144,12 +291,12 @@ func readTransformerStroke(r io.Reader) (TransformerStroke, error) {
 	return t, nil
 }
 
-func readTransformer(r io.Reader) (Transformer, error) {
-	var ttype transformerType
-	err := binary.Read(r, binary.LittleEndian, &ttype)
+func readTransformer(r *byteReader) (Transformer, error) {
+	rawType, err := r.readUint8()
 	if err != nil {
 		return nil, fmt.Errorf("reading type: %w", err)
 	}
+	ttype := transformerType(rawType)
 
 	switch ttype {
 	case transformerTypeAffine:
@@ -175,16 +322,16 @@ func readTransformer(r io.Reader) (Transformer, error) {
 	case transformerTypeStroke:
 		t, err := readTransformerStroke(r)
 		if err != nil {
-			return t, fmt.Errorf("reaiding stroke transformer: %w", err)
+			return nil, fmt.Errorf("reaiding stroke transformer: %w", err)
 		}
 
 		return &t, nil
 	}
 
-	return nil, fmt.Errorf("unknown transformer: %d", ttype)
+	return &OpaqueRecord{Type: uint8(ttype)}, fmt.Errorf("%w: %d", ErrUnknownTransformer, ttype)
 }
 
-func readTranslation(r io.Reader) (TransformerTranslation, error) {
+func readTranslation(r *byteReader) (TransformerTranslation, error) {
 	var t TransformerTranslation
 	x, err := readFloatCoord(r)
 	if err != nil {
@@ -200,14 +347,14 @@ func readTranslation(r io.Reader) (TransformerTranslation, error) {
 	return t, nil
 }
 
-func readLodScale(r io.Reader) (TransformerLodScale, error) {
+func readLodScale(r *byteReader) (TransformerLodScale, error) {
 	var ls TransformerLodScale
-	var minScale uint8
-	var maxScale uint8
-	if err := binary.Read(r, binary.LittleEndian, &minScale); err != nil {
+	minScale, err := r.readUint8()
+	if err != nil {
 		return ls, fmt.Errorf("reading min scale: %w", err)
 	}
-	if err := binary.Read(r, binary.LittleEndian, &maxScale); err != nil {
+	maxScale, err := r.readUint8()
+	if err != nil {
 		return ls, fmt.Errorf("reading max scale: %w", err)
 	}
 	ls.MinS = float32(minScale) / 63.75
@@ -215,3 +362,169 @@ func readLodScale(r io.Reader) (TransformerLodScale, error) {
 
 	return ls, nil
 }
+
+func writeAffine(w io.Writer, t *TransformerAffine) error {
+	if err := writeMatrix(w, t.Matrix[:]); err != nil {
+		return fmt.Errorf("writing matrix: %w", err)
+	}
+
+	return nil
+}
+
+func writeTransformerPerspective(w io.Writer, t *TransformerPerspective) error {
+	if err := writeMatrix(w, t.Matrix[:]); err != nil {
+		return fmt.Errorf("writing matrix: %w", err)
+	}
+
+	return nil
+}
+
+func encodeWidth(width float32) (uint8, error) {
+	v := math.Round(float64(width)) + 128.0
+	if v < 0 || v > math.MaxUint8 || math.IsNaN(v) {
+		return 0, fmt.Errorf("%w: width %f", ErrValueOutOfRange, width)
+	}
+
+	return uint8(v), nil
+}
+
+func encodeMiterLimit(limit float32) (uint8, error) {
+	v := math.Round(float64(limit))
+	if v < 0 || v > math.MaxUint8 || math.IsNaN(v) {
+		return 0, fmt.Errorf("%w: miter limit %f", ErrValueOutOfRange, limit)
+	}
+
+	return uint8(v), nil
+}
+
+func writeContour(w io.Writer, t *TransformerContour) error {
+	width, err := encodeWidth(t.Width)
+	if err != nil {
+		return fmt.Errorf("encoding width: %w", err)
+	}
+	miterLimit, err := encodeMiterLimit(t.MiterLimit)
+	if err != nil {
+		return fmt.Errorf("encoding miter limit: %w", err)
+	}
+
+	err = binary.Write(w, binary.LittleEndian, []uint8{width, uint8(t.LineJoin), miterLimit})
+	if err != nil {
+		return fmt.Errorf("writing contour: %w", err)
+	}
+
+	return nil
+}
+
+func writeTransformerStroke(w io.Writer, t *TransformerStroke) error {
+	width, err := encodeWidth(t.Width)
+	if err != nil {
+		return fmt.Errorf("encoding width: %w", err)
+	}
+	miterLimit, err := encodeMiterLimit(t.MiterLimit)
+	if err != nil {
+		return fmt.Errorf("encoding miter limit: %w", err)
+	}
+	lineOptions := uint8(t.LineJoin)&15 | uint8(t.LineCap)<<4
+
+	err = binary.Write(w, binary.LittleEndian, []uint8{width, lineOptions, miterLimit})
+	if err != nil {
+		return fmt.Errorf("writing stroke: %w", err)
+	}
+
+	return nil
+}
+
+func writeTransformer(w io.Writer, t Transformer) error {
+	var ttype transformerType
+	switch t := t.(type) {
+	case *TransformerAffine:
+		ttype = transformerTypeAffine
+	case *TransformerContour:
+		ttype = transformerTypeContour
+	case *TransformerPerspective:
+		ttype = transformerTypePerspective
+	case *TransformerStroke:
+		ttype = transformerTypeStroke
+	case *OpaqueRecord:
+		if err := writeOpaque(w, t); err != nil {
+			return fmt.Errorf("writing opaque transformer: %w", err)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%w: transformer %T", ErrUnsupportedElement, t)
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, ttype); err != nil {
+		return fmt.Errorf("writing type: %w", err)
+	}
+
+	switch t := t.(type) {
+	case *TransformerAffine:
+		if err := writeAffine(w, t); err != nil {
+			return fmt.Errorf("writing affine transformer: %w", err)
+		}
+	case *TransformerContour:
+		if err := writeContour(w, t); err != nil {
+			return fmt.Errorf("writing countour: %w", err)
+		}
+	case *TransformerPerspective:
+		if err := writeTransformerPerspective(w, t); err != nil {
+			return fmt.Errorf("writing perspective transformer: %w", err)
+		}
+	case *TransformerStroke:
+		if err := writeTransformerStroke(w, t); err != nil {
+			return fmt.Errorf("writing stroke transformer: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func writeTranslation(w io.Writer, t *TransformerTranslation) error {
+	if err := writeFloatCoord(w, t.X); err != nil {
+		return fmt.Errorf("writing x coord: %w", err)
+	}
+	if err := writeFloatCoord(w, t.Y); err != nil {
+		return fmt.Errorf("writing y coord: %w", err)
+	}
+
+	return nil
+}
+
+func encodeLodScale(scale float32) (uint8, error) {
+	v := math.Round(float64(scale) * 63.75)
+	if v < 0 || v > math.MaxUint8 || math.IsNaN(v) {
+		return 0, fmt.Errorf("%w: scale %f", ErrValueOutOfRange, scale)
+	}
+
+	return uint8(v), nil
+}
+
+func writeLodScale(w io.Writer, ls *TransformerLodScale) error {
+	var scales [2]uint8
+	for i, s := range []float32{ls.MinS, ls.MaxS} {
+		v, err := encodeLodScale(s)
+		if err != nil {
+			return fmt.Errorf("encoding scale: %w", err)
+		}
+		scales[i] = v
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, scales); err != nil {
+		return fmt.Errorf("writing scales: %w", err)
+	}
+
+	return nil
+}
+
+func writeOpaque(w io.Writer, o *OpaqueRecord) error {
+	if err := binary.Write(w, binary.LittleEndian, o.Type); err != nil {
+		return fmt.Errorf("writing type: %w", err)
+	}
+	if _, err := w.Write(o.Data); err != nil {
+		return fmt.Errorf("writing data: %w", err)
+	}
+
+	return nil
+}
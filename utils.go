@@ -1,22 +1,23 @@
 package hvif
 
 import (
-	"encoding/binary"
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 )
 
-func readFloatCoord(r io.Reader) (float32, error) {
+func readFloatCoord(r *byteReader) (float32, error) {
 	var val uint16
-	var x uint8
-	if err := binary.Read(r, binary.LittleEndian, &x); err != nil {
+	x, err := r.readUint8()
+	if err != nil {
 		return 0, fmt.Errorf("reading first part: %w", err)
 	}
 	val = uint16(x)
 	if val&0x80 != 0 {
-		var xlow uint8
-		err := binary.Read(r, binary.LittleEndian, &xlow)
+		xlow, err := r.readUint8()
 		if err != nil {
 			return 0, fmt.Errorf("reading second part: %w", err)
 		}
@@ -29,49 +30,306 @@ func readFloatCoord(r io.Reader) (float32, error) {
 	return float32(val) - 32.0, nil
 }
 
-func readFloat24(r io.Reader) (float32, error) {
-	var b1 uint8
-	err := binary.Read(r, binary.LittleEndian, &b1)
-	if err != nil {
-		return 0, fmt.Errorf("reading first byte: %w", err)
-	}
-
-	var b2 uint8
-	err = binary.Read(r, binary.LittleEndian, &b2)
+func readFloat24(r *byteReader) (float32, error) {
+	b, err := r.readBytes(3)
 	if err != nil {
-		return 0, fmt.Errorf("reading second byte: %w", err)
+		return 0, fmt.Errorf("reading bytes: %w", err)
 	}
 
-	var b3 uint8
-	err = binary.Read(r, binary.LittleEndian, &b3)
-	if err != nil {
-		return 0, fmt.Errorf("reading third byte: %w", err)
-	}
+	return decodeFloat24(uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])), nil
+}
 
-	value := uint32(b1)<<16 | uint32(b2)<<8 | uint32(b3)
+func decodeFloat24(value uint32) float32 {
 	if value == 0 {
-		return 0.0, nil
+		return 0.0
 	}
 
 	sign := ((value & 0b100000000000000000000000) >> 23)
 	expo := ((value & 0b011111100000000000000000) >> 17) - 32
-	mant := ((value & 0b000000011111111111111111) >> 6)
+	mant := ((value & 0b000000011111111111111111) << 6)
 
 	bits := (sign << 31) | ((expo + 127) << 23) | mant
 
-	return math.Float32frombits(bits), nil
+	return math.Float32frombits(bits)
 }
 
-func readMatrix(r io.Reader, size int) ([]float32, error) {
-	res := make([]float32, size)
+func readMatrix(r *byteReader, mx []float32) error {
 	var err error
+	for i := range mx {
+		mx[i], err = readFloat24(r)
+		if err != nil {
+			return fmt.Errorf("reading float24: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func checkFlags(raw, known uint8) error {
+	if raw&^known != 0 {
+		return fmt.Errorf("%w: %#02x", ErrUnknownFlags, raw&^known)
+	}
+
+	return nil
+}
+
+// Coordinates are stored either as integers in [-32, 95] taking one byte, or
+// with 1/102 precision in [MinCoord, MaxCoord] taking two bytes.
+const (
+	MinCoord float32 = -128.0
+	MaxCoord float32 = 0x7fff/102.0 - 128.0
+)
+
+var ErrCoordOutOfRange = errors.New("coordinate out of range")
+
+// AppendCoord appends the encoded coordinate to dst.
+func AppendCoord(dst []byte, v float32) ([]byte, error) {
+	if floatCoordSize(v) == 1 {
+		return append(dst, uint8(v+32.0)), nil
+	}
+
+	scaled := math.Round((float64(v) + 128.0) * 102.0)
+	if scaled < 0 || scaled > 0x7fff || math.IsNaN(scaled) {
+		return dst, fmt.Errorf("%w: %f", ErrCoordOutOfRange, v)
+	}
+	val := uint16(scaled) | 0x8000
+
+	// High byte goes first
+	return append(dst, uint8(val>>8), uint8(val)), nil
+}
+
+// QuantizeCoord returns the value v is decoded as after being encoded. Values
+// outside of [MinCoord, MaxCoord] are clamped and reported with false.
+func QuantizeCoord(v float32) (float32, bool) {
+	inRange := v >= MinCoord && v <= MaxCoord
+	switch {
+	case v < MinCoord || math.IsNaN(float64(v)):
+		v = MinCoord
+	case v > MaxCoord:
+		v = MaxCoord
+	}
+
+	if floatCoordSize(v) == 1 {
+		return v, inRange
+	}
+
+	val := uint16(math.Round((float64(v) + 128.0) * 102.0))
+
+	return float32(val)/102.0 - 128.0, inRange
+}
+
+func writeFloatCoord(w io.Writer, v float32) error {
+	var buf [2]byte
+	data, err := AppendCoord(buf[:0], v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("writing value: %w", err)
+	}
+
+	return nil
+}
+
+// Float24 values have 1 sign bit, 6 exponent bits with bias 32 and 17
+// mantissa bits. A zero exponent is reserved for zero, so the magnitude of
+// non-zero values lies in [2^-31, 2^32).
+const (
+	float24MinExponent = -31
+	float24MaxExponent = 31
+)
+
+var ErrFloat24Overflow = errors.New("value does not fit into float24")
+
+// encodeFloat24 rounds the mantissa of v to the nearest float24, ties to even.
+// Values too small to be represented, including float32 denormals, are
+// flushed to zero.
+func encodeFloat24(v float32) (uint32, error) {
+	if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+		return 0, fmt.Errorf("%w: %f", ErrFloat24Overflow, v)
+	}
+
+	bits := math.Float32bits(v)
+	sign := bits >> 31
+	abs := bits & 0x7fffffff
+
+	// Carry of the rounding propagates into the exponent
+	rounded := (abs + 0x1f + (abs>>6)&1) &^ 0x3f
+	expo := int32(rounded>>23) - 127
+
+	switch {
+	case expo > float24MaxExponent:
+		return 0, fmt.Errorf("%w: %f", ErrFloat24Overflow, v)
+	case expo < float24MinExponent:
+		return 0, nil
+	}
+
+	return sign<<23 | uint32(expo+32)<<17 | (rounded&0x7fffff)>>6, nil
+}
+
+// AppendFloat24 appends v encoded as float24 to dst.
+func AppendFloat24(dst []byte, v float32) ([]byte, error) {
+	value, err := encodeFloat24(v)
+	if err != nil {
+		return dst, err
+	}
+
+	return append(dst, uint8(value>>16), uint8(value>>8), uint8(value)), nil
+}
+
+// QuantizeFloat24 returns the value v is decoded as after being encoded.
+func QuantizeFloat24(v float32) (float32, error) {
+	value, err := encodeFloat24(v)
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeFloat24(value), nil
+}
+
+// IsFloat24Exact reports whether v survives encoding without loss.
+func IsFloat24Exact(v float32) bool {
+	q, err := QuantizeFloat24(v)
 
-	for i := range size {
-		res[i], err = readFloat24(r)
+	return err == nil && q == v
+}
+
+func isMatrixExact(mx []float32) bool {
+	for _, v := range mx {
+		if !IsFloat24Exact(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeFloat24(w io.Writer, v float32) error {
+	var buf [3]byte
+	data, err := AppendFloat24(buf[:0], v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("writing value: %w", err)
+	}
+
+	return nil
+}
+
+func writeMatrix(w io.Writer, mx []float32) error {
+	for i, v := range mx {
+		if err := writeFloat24(w, v); err != nil {
+			return fmt.Errorf("writing float24 [%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// floatCoordSize returns the number of bytes writeFloatCoord uses for v.
+func floatCoordSize(v float32) int {
+	if v == float32(math.Trunc(float64(v))) && v >= -32.0 && v <= 95.0 {
+		return 1
+	}
+
+	return 2
+}
+
+// byteReader is the source read helpers consume. It either walks over data
+// without copying, or pulls bytes from a buffered stream. It keeps track of
+// the number of consumed bytes to report offsets.
+type byteReader struct {
+	data []byte
+	src  interface {
+		io.Reader
+		io.ByteReader
+	}
+	n       int64
+	scratch []byte
+}
+
+func newByteReader(data []byte) *byteReader {
+	return &byteReader{data: data}
+}
+
+func newStreamReader(r io.Reader) *byteReader {
+	br := &byteReader{}
+	switch r := r.(type) {
+	case *bufio.Reader:
+		br.src = r
+	case *bytes.Reader:
+		br.src = r
+	default:
+		br.src = bufio.NewReader(r)
+	}
+
+	return br
+}
+
+func (r *byteReader) readUint8() (uint8, error) {
+	if r.src != nil {
+		b, err := r.src.ReadByte()
+		if err != nil {
+			return 0, err //nolint:wrapcheck
+		}
+		r.n++
+
+		return b, nil
+	}
+
+	if r.n >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	b := r.data[r.n]
+	r.n++
+
+	return b, nil
+}
+
+// readBytes returns the next n bytes. The result is only valid until the next
+// call, it must be copied to be retained.
+func (r *byteReader) readBytes(n int) ([]byte, error) {
+	if r.src != nil {
+		if cap(r.scratch) < n {
+			r.scratch = make([]byte, n)
+		}
+		read, err := io.ReadFull(r.src, r.scratch[:n])
+		r.n += int64(read)
 		if err != nil {
-			return res, fmt.Errorf("reading float24: %w", err)
+			return nil, err //nolint:wrapcheck
+		}
+
+		return r.scratch[:n], nil
+	}
+
+	rest := r.data[r.n:]
+	if len(rest) < n {
+		r.n = int64(len(r.data))
+		if len(rest) == 0 {
+			return nil, io.EOF
 		}
+
+		return nil, io.ErrUnexpectedEOF
 	}
+	r.n += int64(n)
+
+	return rest[:n], nil
+}
+
+// readAll returns a copy of the remaining bytes, up to the end of the stream.
+func (r *byteReader) readAll() ([]byte, error) {
+	if r.src != nil {
+		data, err := io.ReadAll(r.src)
+		r.n += int64(len(data))
+
+		return data, err //nolint:wrapcheck
+	}
+
+	data := bytes.Clone(r.data[r.n:])
+	r.n = int64(len(r.data))
 
-	return res, nil
+	return data, nil
 }
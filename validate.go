@@ -0,0 +1,279 @@
+package hvif
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrTooManyEntries     = errors.New("too many entries")
+	ErrEmptyShape         = errors.New("shape has no pathes")
+	ErrMissingStyle       = errors.New("shape has no style")
+	ErrGradientStops      = errors.New("bad gradient stops")
+	ErrValueOutOfRange    = errors.New("value out of range")
+	ErrMisplacedOpaque    = errors.New("opaque record is not the last one")
+	ErrUnsupportedElement = errors.New("unsupported element")
+)
+
+// Problem is an issue found in an image by Validate.
+type Problem struct {
+	Section Section
+	Index   int // Index of the element within its section, -1 for the whole section
+	Element int // Index of the path element, gradient stop, shape path or transformer, -1 otherwise
+
+	// Warnings do not prevent the image from being written. Haiku sorts
+	// gradient stops and ignores empty shapes.
+	Warning bool
+	Err     error
+}
+
+func (p Problem) Error() string {
+	switch {
+	case p.Index < 0:
+		return fmt.Sprintf("%s: %v", p.Section, p.Err)
+	case p.Element >= 0:
+		return fmt.Sprintf("%s [%d] element [%d]: %v", p.Section, p.Index, p.Element, p.Err)
+	default:
+		return fmt.Sprintf("%s [%d]: %v", p.Section, p.Index, p.Err)
+	}
+}
+
+func (p Problem) Unwrap() error {
+	return p.Err
+}
+
+// InvalidImageError is returned by the encoder for images with problems
+// other than warnings.
+type InvalidImageError struct {
+	Problems []Problem
+}
+
+func (e *InvalidImageError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.Error())
+	}
+
+	return "invalid image: " + strings.Join(msgs, "; ")
+}
+
+func (e *InvalidImageError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		errs = append(errs, p)
+	}
+
+	return errs
+}
+
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) report(section Section, index, element int, err error) {
+	v.problems = append(v.problems, Problem{Section: section, Index: index, Element: element, Err: err})
+}
+
+func (v *validator) warn(section Section, index, element int, err error) {
+	v.problems = append(v.problems, Problem{Section: section, Index: index, Element: element, Warning: true, Err: err})
+}
+
+func (v *validator) count(section Section, index int, what string, n int) {
+	if n > math.MaxUint8 {
+		v.report(section, index, -1, fmt.Errorf("%w: %d %s", ErrTooManyEntries, n, what))
+	}
+}
+
+func (v *validator) coords(section Section, index, element int, coords ...float32) {
+	for _, c := range coords {
+		if _, ok := QuantizeCoord(c); !ok {
+			v.report(section, index, element, fmt.Errorf("%w: %v", ErrCoordOutOfRange, c))
+		}
+	}
+}
+
+// matrix reports the first value not fitting into float24.
+func (v *validator) matrix(section Section, index, element int, m []float32) {
+	for _, f := range m {
+		if _, err := encodeFloat24(f); err != nil {
+			v.report(section, index, element, err)
+
+			return
+		}
+	}
+}
+
+func (v *validator) style(styleID int, s Style) {
+	g, ok := s.(*Gradient)
+	if !ok {
+		if s == nil {
+			v.report(SectionStyle, styleID, -1, fmt.Errorf("%w: nil style", ErrUnsupportedElement))
+		}
+
+		return
+	}
+
+	if g.Transformable != nil {
+		v.matrix(SectionStyle, styleID, -1, g.Transformable.Matrix[:])
+	}
+	if len(g.Colors) != len(g.Offsets) {
+		v.report(SectionStyle, styleID, -1,
+			fmt.Errorf("%w: %d colors and %d offsets", ErrGradientStops, len(g.Colors), len(g.Offsets)))
+
+		return
+	}
+	if len(g.Colors) > math.MaxUint8 {
+		v.report(SectionStyle, styleID, -1, fmt.Errorf("%w: %d stops", ErrGradientStops, len(g.Colors)))
+	}
+	for i := 1; i < len(g.Offsets); i++ {
+		if g.Offsets[i] < g.Offsets[i-1] {
+			v.warn(SectionStyle, styleID, i, fmt.Errorf("%w: offset %d", ErrUnorderedOffsets, g.Offsets[i]))
+		}
+	}
+}
+
+func (v *validator) path(pathID int, p *Path) {
+	v.count(SectionPath, pathID, "elements", len(p.Elements))
+
+	for i, e := range p.Elements {
+		switch e := e.(type) {
+		case *Point:
+			v.coords(SectionPath, pathID, i, e.X, e.Y)
+		case *HLine:
+			v.coords(SectionPath, pathID, i, e.X)
+		case *VLine:
+			v.coords(SectionPath, pathID, i, e.Y)
+		case *Curve:
+			v.coords(SectionPath, pathID, i, e.PointIn.X, e.PointIn.Y, e.Point.X, e.Point.Y, e.PointOut.X, e.PointOut.Y)
+		default:
+			v.report(SectionPath, pathID, i, fmt.Errorf("%w: nil element", ErrUnsupportedElement))
+		}
+	}
+}
+
+func (v *validator) shape(img *Image, shapeID int, sp *Shape) {
+	if sp.hasOpaque() && shapeID != len(img.shapes)-1 {
+		v.report(SectionShape, shapeID, -1, ErrMisplacedOpaque)
+	}
+	if sp.Opaque != nil {
+		return
+	}
+
+	switch {
+	case sp.style == nil:
+		v.report(SectionShape, shapeID, -1, ErrMissingStyle)
+	case !slices.Contains(img.styles, sp.style):
+		v.report(SectionShape, shapeID, -1, fmt.Errorf("%w: style is not in the image", ErrDanglingReference))
+	}
+
+	if len(sp.paths) == 0 {
+		v.warn(SectionShape, shapeID, -1, ErrEmptyShape)
+	}
+	v.count(SectionShape, shapeID, "pathes", len(sp.paths))
+	for i, p := range sp.paths {
+		if !slices.Contains(img.pathes, p) {
+			v.report(SectionShape, shapeID, i, fmt.Errorf("%w: path is not in the image", ErrDanglingReference))
+		}
+	}
+
+	_, header, list := sp.splitTransforms()
+	v.count(SectionShape, shapeID, "transformers", len(list))
+
+	// The header is checked as written, with the affine transformation and
+	// the translation folded into one
+	_, written, _ := sp.fileTransforms()
+	for i, t := range written {
+		if i > 0 {
+			i += len(header) - len(written)
+		}
+		v.transformer(shapeID, i, t, true)
+	}
+
+	for i, t := range list {
+		i += len(header)
+		if _, ok := t.(*OpaqueRecord); ok && i != len(sp.Transforms)-1 {
+			v.report(SectionShape, shapeID, i, ErrMisplacedOpaque)
+		}
+		v.transformer(shapeID, i, t, false)
+	}
+}
+
+func (v *validator) transformer(shapeID, element int, t Transformer, header bool) {
+	switch t := t.(type) {
+	case *TransformerTranslation:
+		if !header {
+			v.report(SectionShape, shapeID, element, fmt.Errorf("%w: translation out of the header", ErrUnsupportedElement))
+
+			return
+		}
+		v.coords(SectionShape, shapeID, element, t.X, t.Y)
+	case *TransformerLodScale:
+		if !header {
+			v.report(SectionShape, shapeID, element, fmt.Errorf("%w: lod scale out of the header", ErrUnsupportedElement))
+
+			return
+		}
+		for _, s := range []float32{t.MinS, t.MaxS} {
+			if _, err := encodeLodScale(s); err != nil {
+				v.report(SectionShape, shapeID, element, err)
+			}
+		}
+	case *TransformerAffine:
+		v.matrix(SectionShape, shapeID, element, t.Matrix[:])
+	case *TransformerPerspective:
+		v.matrix(SectionShape, shapeID, element, t.Matrix[:])
+	case *TransformerStroke:
+		v.outline(shapeID, element, t.Width, t.MiterLimit)
+	case *TransformerContour:
+		v.outline(shapeID, element, t.Width, t.MiterLimit)
+	case *OpaqueRecord:
+		// Written back as found
+	default:
+		v.report(SectionShape, shapeID, element, fmt.Errorf("%w: nil transformer", ErrUnsupportedElement))
+	}
+}
+
+func (v *validator) outline(shapeID, element int, width, miterLimit float32) {
+	if _, err := encodeWidth(width); err != nil {
+		v.report(SectionShape, shapeID, element, err)
+	}
+	if _, err := encodeMiterLimit(miterLimit); err != nil {
+		v.report(SectionShape, shapeID, element, err)
+	}
+}
+
+// Validate reports everything preventing the image from being written, as
+// well as warnings about suspicious content.
+func (i *Image) Validate() []Problem {
+	var v validator
+
+	v.count(SectionStyle, -1, "styles", len(i.styles))
+	for styleID, s := range i.styles {
+		v.style(styleID, s)
+	}
+
+	v.count(SectionPath, -1, "pathes", len(i.pathes))
+	for pathID, p := range i.pathes {
+		if p == nil {
+			v.report(SectionPath, pathID, -1, fmt.Errorf("%w: nil path", ErrUnsupportedElement))
+
+			continue
+		}
+		v.path(pathID, p)
+	}
+
+	v.count(SectionShape, -1, "shapes", len(i.shapes))
+	for shapeID, sp := range i.shapes {
+		if sp == nil {
+			v.report(SectionShape, shapeID, -1, fmt.Errorf("%w: nil shape", ErrUnsupportedElement))
+
+			continue
+		}
+		v.shape(i, shapeID, sp)
+	}
+
+	return v.problems
+}